@@ -4,19 +4,24 @@ package agent // import "github.com/moooofly/opencensus-go-exporter-hunter"
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 	"google.golang.org/api/support/bundler"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
-	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/metricsproto"
+	"github.com/golang/protobuf/proto"
 )
 
 var _ trace.Exporter = (*Exporter)(nil)
@@ -26,33 +31,162 @@ type Exporter struct {
 	*options
 	overflowLogger
 
-	mu           sync.Mutex
-	started      bool
-	stopped      bool
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	state   State
+	// stateChanges queues the transitions for the OnStateChange hook.
+	stateChanges *stateQueue
+	// closing is set atomically once Shutdown begins, from then on
+	// ExportSpan ignores new spans.
+	closing int32
+	// endpoints lists the configured transports, most preferred first.
+	endpoints    []string
+	proto        string
 	clientConn   *grpc.ClientConn
-	exportClient exporterproto.Export_ExportSpanClient
+	exportClient *spanStream
+	// ready is closed once exportClient is set, and replaced by a new
+	// channel when the connection is lost, see WaitReady.
+	ready chan struct{}
+	// done is closed by Stop to terminate background reconnection.
+	done chan struct{}
+
+	// bundled and inflight count the spans waiting in the bundler and the
+	// ones handed to uploadSpans, respectively. Accessed atomically.
+	bundled  int64
+	inflight int64
+
+	// sendMu serializes Send calls on exportClient, since a gRPC stream
+	// must not be written to from several goroutines at once.
+	sendMu sync.Mutex
+	// sentStacks holds the hash IDs of the stack traces already sent on
+	// sentStacksStream, see dedupStacks. Guarded by sendMu.
+	sentStacks       map[uint64]bool
+	sentStacksStream *spanStream
+
+	// children counts the children of the spans not exported yet.
+	children *childCounts
+
+	conv *converter
 
 	bundler *bundler.Bundler
+	// queue holds the batches that failed to upload until they can be
+	// resent, see uploadSpans.
+	queue *retryQueue
+	// spool, if enabled, takes over the batches the queue cannot hold.
+	spool *spool
+	// spoolKick wakes up drainSpool.
+	spoolKick chan struct{}
+
+	// creds secures the tcp endpoint, nil means plaintext.
+	creds credentials.TransportCredentials
+
+	// metricsClient is the ExportMetrics stream on clientConn, opened by
+	// the first upload of metrics, see metricsStream.
+	metricsClient exporterproto.Export_ExportMetricsClient
+	// metricsDone is closed once the receiving side of metricsClient has
+	// ended, see watchMetricsStream.
+	metricsDone chan struct{}
+	// metricsMu serializes Send calls on metricsClient.
+	metricsMu      sync.Mutex
+	metricsBundler *bundler.Bundler
+	// metricsBundled and metricsInflight are the counterparts of bundled
+	// and inflight for metrics. Accessed atomically.
+	metricsBundled  int64
+	metricsInflight int64
+
+	// bundledBytes is the encoded size of the spans in bundled. Accessed
+	// atomically.
+	bundledBytes int64
+	// oversizedBytes is the encoded size of the spans too large for a
+	// bundle being uploaded on their own. Accessed atomically.
+	oversizedBytes int64
+	// oversized tracks the goroutines uploading them, for FlushContext.
+	oversized uploadGroup
+
+	// debugMu guards the diagnostics shown by DebugHandler.
+	debugMu        sync.Mutex
+	lastErr        error
+	lastErrTime    time.Time
+	droppedSpans   map[string]int64 // by reason
+	droppedMetrics int64
+	truncatedSpans int64
+	splitBatches   int64
+}
+
+var (
+	errNoConnection = errors.New("no connection to Hunter agent")
+	errStopped      = errors.New("exporter stopped")
+)
+
+// spanStream is an ExportSpan stream, along with what closing it without
+// losing data takes, see closeStreams.
+type spanStream struct {
+	exporterproto.Export_ExportSpanClient
+	// done is closed once the receiving side of the stream has ended.
+	done chan struct{}
+	// sent counts the spans sent on the stream. Accessed atomically.
+	sent int64
+}
+
+// DroppedSpansError is reported through the ErrFun hook when spans are
+// permanently lost.
+type DroppedSpansError struct {
+	// Count is the number of spans dropped.
+	Count int
+	// Reason tells why they were dropped.
+	Reason string
+}
+
+func (e *DroppedSpansError) Error() string {
+	return fmt.Sprintf("dropped %d spans: %s", e.Count, e.Reason)
 }
 
 // NewExporter returns an implementation of trace.Exporter that exports spans
 // to Hunter agent.
 func NewExporter(opt ...ExporterOption) (*Exporter, error) {
 
-	e := &Exporter{}
-
-	opts := defaultExporterOptions
-	for _, o := range opt {
-		o(&opts)
+	e := &Exporter{
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
+		spoolKick:    make(chan struct{}, 1),
+		droppedSpans: make(map[string]int64),
+		stateChanges: newStateQueue(),
+		children:     newChildCounts(),
 	}
 
-	preferred, err := preferedAddr(&opts)
+	opts := newOptions(opt...)
+
+	endpoints, err := endpointOrder(&opts)
 	if err != nil {
 		return nil, err
 	}
+	e.endpoints = endpoints
 
-	bundler := bundler.NewBundler((*trace.SpanData)(nil), func(bundle interface{}) {
-		e.uploadSpans(bundle.([]*trace.SpanData))
+	creds, err := transportCredentials(&opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+	e.creds = creds
+
+	metricsBundler := bundler.NewBundler((*metricsproto.Metric)(nil), func(bundle interface{}) {
+		metrics := bundle.([]*metricsproto.Metric)
+		atomic.AddInt64(&e.metricsBundled, -int64(len(metrics)))
+		e.uploadMetrics(metrics)
+	})
+	metricsBundler.BundleCountThreshold = 100
+
+	bundler := bundler.NewBundler((*spanBuf)(nil), func(bundle interface{}) {
+		spans := bundle.([]*spanBuf)
+		atomic.AddInt64(&e.inflight, int64(len(spans)))
+		atomic.AddInt64(&e.bundled, -int64(len(spans)))
+		var size int
+		for _, s := range spans {
+			size += s.size
+		}
+		atomic.AddInt64(&e.bundledBytes, -int64(size))
+		e.uploadSpans(spans)
+		atomic.AddInt64(&e.inflight, -int64(len(spans)))
 	})
 
 	// FIXME(moooofly): need to optimize
@@ -73,22 +207,75 @@ func NewExporter(opt ...ExporterOption) (*Exporter, error) {
 		bundler.BundleCountThreshold = 300
 	}
 
-	// Once the number of bytes in current bundle reaches this threshold, handle
-	// the bundle. The default is DefaultBundleByteThreshold (1M). This triggers handling,
-	// but does not cap the total size of a bundle.
-	bundler.BundleByteThreshold = bundler.BundleCountThreshold * 1000
-	// The maximum size of a bundle, in bytes. Zero means unlimited.
-	bundler.BundleByteLimit = bundler.BundleCountThreshold * 1000
+	// Spans are accounted by their encoded size. Once the spans in the
+	// current bundle reach this many bytes, handle the bundle. A span that
+	// would take the bundle over it starts a new one, so it also serves as a
+	// limit: a span larger than it is uploaded on its own, see ExportSpan.
+	if opts.bundleByteThreshold > 0 {
+		bundler.BundleByteThreshold = opts.bundleByteThreshold
+	} else {
+		bundler.BundleByteThreshold = 1 << 20
+	}
+	bundler.BundleByteLimit = bundler.BundleByteThreshold
 	// The maximum number of bytes that the Bundler will keep in memory before
-	// returning ErrOverflow. The default is DefaultBufferedByteLimit (1G).
-	bundler.BufferedByteLimit = bundler.BundleCountThreshold * 1000 * 1000
+	// returning ErrOverflow.
+	if opts.bufferedByteLimit > 0 {
+		bundler.BufferedByteLimit = opts.bufferedByteLimit
+	} else {
+		bundler.BufferedByteLimit = 64 << 20
+	}
+
+	metricsBundler.DelayThreshold = bundler.DelayThreshold
+
+	if opts.maxMessageSize <= 0 {
+		opts.maxMessageSize = DefaultMaxMessageSize
+	}
 
 	e.options = &opts
+	e.overflowLogger.out = opts.logger
+	e.conv = &converter{
+		limits:         opts.spanLimits,
+		unknown:        opts.unknownAttributes,
+		annotationKeys: opts.annotationKeys,
+		logger:         opts.logger,
+		onError:        e.onError,
+	}
 	e.bundler = bundler
+	e.metricsBundler = metricsBundler
+	e.queue = newRetryQueue(opts.retryQueueBytes, opts.retryQueueAge)
 
-	err = e.Start(preferred)
-	if err != nil {
-		return nil, err
+	if opts.spoolDir != "" {
+		e.spool, err = openSpool(opts.spoolDir, opts.spoolBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open spool: %v", err)
+		}
+	}
+
+	if opts.nonBlocking {
+		e.mu.Lock()
+		e.started = true
+		e.mu.Unlock()
+		go e.redial()
+	} else {
+		err = e.Start(endpoints[0])
+		if err != nil {
+			if e.spool != nil {
+				e.spool.close()
+			}
+			return nil, err
+		}
+	}
+
+	if e.spool != nil {
+		go e.drainSpool()
+		// Replay what a previous process left in the spool.
+		e.kickSpool()
+	}
+	if len(endpoints) > 1 && opts.probeInterval > 0 {
+		go e.probePreferred()
+	}
+	if opts.onStateChange != nil {
+		go e.stateChanges.deliver(opts.onStateChange)
 	}
 
 	return e, nil
@@ -99,48 +286,303 @@ func (e *Exporter) doStart(proto string) error {
 		return nil
 	}
 
+	proto, cc, stream, err := e.connect(proto)
+	if err != nil {
+		return err
+	}
+	e.setConn(proto, cc, stream)
+
+	return nil
+}
+
+// connect dials the configured endpoints in order, starting with first, and
+// returns the transport of the first one that succeeds. The whole list is
+// retried with exponential backoff.
+func (e *Exporter) connect(first string) (string, *grpc.ClientConn, exporterproto.Export_ExportSpanClient, error) {
+	order := []string{first}
+	for _, proto := range e.endpoints {
+		if proto != first {
+			order = append(order, proto)
+		}
+	}
+
+	var (
+		proto  string
+		cc     *grpc.ClientConn
+		stream exporterproto.Export_ExportSpanClient
+	)
+	err := e.retryPolicy.retry(e.done, func() error {
+		var err error
+		for _, proto = range order {
+			// NOTE: THIS IS A BLOCK CALL
+			cc, stream, err = e.dial(proto)
+			if err == nil {
+				return nil
+			}
+			e.logger.Warn("cannot connect to agent", "transport", proto, "addr", e.addrs[proto], "err", err)
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return proto, cc, stream, nil
+}
+
+// dial connects to the Hunter agent listening on proto and opens the
+// ExportSpan stream on the new connection.
+func (e *Exporter) dial(proto string) (*grpc.ClientConn, exporterproto.Export_ExportSpanClient, error) {
+	if proto == "unix" {
+		// Fail fast instead of waiting for the dial timeout when the
+		// socket file is missing, so that fallback happens right away.
+		if _, err := os.Stat(e.addrs[proto]); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	dialOpts := []grpc.DialOption{
 		grpc.WithBlock(),
-		grpc.WithInsecure(),
-		grpc.WithTimeout(3 * time.Second),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(e.maxMessageSize)),
+		grpc.WithTimeout(e.retryPolicy.DialTimeout),
 		grpc.WithDialer(
 			func(addr string, timeout time.Duration) (net.Conn, error) {
 				return net.DialTimeout(proto, addr, timeout)
 			}),
 	}
+	// NOTE: the unix socket is local to the node, only tcp needs TLS.
+	if proto == "tcp" && e.creds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(e.creds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
 
-	var cc *grpc.ClientConn
-	// NOTE: In the worst case of (no agent actually available), it will take at least:
-	//      (5 * 1s) + ((1<<5)-1) * 0.05 s = 5s + 1.55s = 6.55s
-	dialBackoffWaitPeriod := 50 * time.Millisecond
-	err := retryWithExponentialBackoff(5, dialBackoffWaitPeriod, func() error {
-		var err error
-		// NOTE: THIS IS A BLOCK CALL
-		cc, err = grpc.Dial(e.addrs[proto], dialOpts...)
-		return err
-	})
+	cc, err := grpc.Dial(e.addrs[proto], dialOpts...)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	e.clientConn = cc
 
-	exportClientStream, err := exporterproto.NewExportClient(cc).ExportSpan(context.Background())
+	stream, err := exporterproto.NewExportClient(cc).ExportSpan(context.Background())
 	if err != nil {
-		return err
+		cc.Close()
+		return nil, nil, err
 	}
-	e.exportClient = exportClientStream
 
-	return nil
+	return cc, stream, nil
+}
+
+// setConn installs a freshly dialed connection and its stream.
+// e.mu must be held.
+func (e *Exporter) setConn(proto string, cc *grpc.ClientConn, stream exporterproto.Export_ExportSpanClient) {
+	if e.exportClient == nil {
+		close(e.ready)
+	}
+	e.setState(Ready)
+	s := &spanStream{Export_ExportSpanClient: stream, done: make(chan struct{})}
+	e.proto = proto
+	e.clientConn = cc
+	e.exportClient = s
+	// The metrics stream, if any, belongs to the previous connection.
+	e.metricsClient = nil
+	e.metricsDone = nil
+	go e.watchStream(s)
+}
+
+// watchStream blocks on the receiving side of stream so that a broken
+// stream, e.g. because the agent restarted, is noticed even while no spans
+// are being sent.
+func (e *Exporter) watchStream(stream *spanStream) {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			close(stream.done)
+			e.reconnect(stream)
+			return
+		}
+	}
+}
+
+// closeStreams closes the sending side of the span stream s and of the
+// metrics stream m, either may be nil, and waits for the agent to end them,
+// which it does once it has read everything sent on them: a successful Send
+// only means the request was buffered. Their connection must be closed
+// afterwards, and not be used to send anything else meanwhile.
+//
+// If ctx is done first, closeStreams returns the number of spans sent on s
+// along with ctx.Err(), since there is no telling how many of them the agent
+// has read.
+func (e *Exporter) closeStreams(ctx context.Context, s *spanStream, m exporterproto.Export_ExportMetricsClient, mdone <-chan struct{}) (int, error) {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		// Not while a Send is in progress, see sendMu and metricsMu.
+		if s != nil {
+			e.sendMu.Lock()
+			s.CloseSend()
+			e.sendMu.Unlock()
+		}
+		if m != nil {
+			e.metricsMu.Lock()
+			m.CloseSend()
+			e.metricsMu.Unlock()
+		}
+		if s != nil {
+			<-s.done
+		}
+		if m != nil {
+			<-mdone
+		}
+	}()
+
+	select {
+	case <-closed:
+		return 0, nil
+	case <-ctx.Done():
+		if s == nil {
+			return 0, ctx.Err()
+		}
+		return int(atomic.LoadInt64(&s.sent)), ctx.Err()
+	}
+}
+
+// reconnect tears down the connection owning the broken stream and redials
+// the agent in the background. It does nothing if the stream has already
+// been replaced or the exporter is stopped.
+func (e *Exporter) reconnect(broken *spanStream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stopped || e.exportClient != broken {
+		return
+	}
+
+	e.exportClient = nil
+	e.metricsClient = nil
+	e.metricsDone = nil
+	e.ready = make(chan struct{})
+	e.setState(Connecting)
+	if e.clientConn != nil {
+		e.clientConn.Close()
+		e.clientConn = nil
+	}
+
+	stats.Record(context.Background(), Reconnects.M(1))
+	e.logger.Warn("connection to agent is broken, reconnecting")
+	go e.redial()
+}
+
+// redial keeps dialing the agent with exponential backoff, preferred
+// transport first, until it succeeds or the exporter is stopped. It is used
+// both to reconnect and for the initial connection of a NonBlocking exporter.
+func (e *Exporter) redial() {
+	for {
+		proto, cc, stream, err := e.connect(e.endpoints[0])
+		if err == nil {
+			e.mu.Lock()
+			if e.stopped {
+				e.mu.Unlock()
+				cc.Close()
+				return
+			}
+			e.setConn(proto, cc, stream)
+			e.mu.Unlock()
+
+			e.logger.Info("connected to agent", "transport", proto, "addr", e.addrs[proto])
+			go e.flushRetryQueue()
+			e.kickSpool()
+			return
+		}
+
+		e.mu.Lock()
+		if e.stopped {
+			e.mu.Unlock()
+			return
+		}
+		e.setState(TransientFailure)
+		e.mu.Unlock()
+
+		wait := e.retryPolicy.MaxDelay
+		if wait <= 0 {
+			wait = e.retryPolicy.delay(e.retryPolicy.MaxAttempts)
+		}
+		e.onError(fmt.Errorf("cannot connect to agent, retrying in %v: %v", wait, err))
+
+		select {
+		case <-e.done:
+			return
+		case <-time.After(wait):
+		}
+
+		e.mu.Lock()
+		e.setState(Connecting)
+		e.mu.Unlock()
+	}
+}
+
+// streamCloseTimeout bounds the wait for the agent to read what was sent on
+// the streams of a connection being replaced, see closeStreams.
+const streamCloseTimeout = 10 * time.Second
+
+// probePreferred periodically tries the preferred transport while the
+// exporter is connected through another one, and switches back to it as
+// soon as it can be dialed.
+func (e *Exporter) probePreferred() {
+	preferred := e.endpoints[0]
+
+	ticker := time.NewTicker(e.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		e.mu.Lock()
+		fallback := e.exportClient != nil && e.proto != preferred
+		e.mu.Unlock()
+		if !fallback {
+			continue
+		}
+
+		cc, stream, err := e.dial(preferred)
+		if err != nil {
+			continue
+		}
+
+		// Hold sendMu so that no batch is being written to the old stream.
+		e.sendMu.Lock()
+		e.mu.Lock()
+		if e.stopped || e.exportClient == nil {
+			// Stopped, or reconnecting, which will try preferred first.
+			e.mu.Unlock()
+			e.sendMu.Unlock()
+			cc.Close()
+			continue
+		}
+		oldProto, oldConn, old := e.proto, e.clientConn, e.exportClient
+		oldMetrics, oldMetricsDone := e.metricsClient, e.metricsDone
+		e.setConn(preferred, cc, stream)
+		e.mu.Unlock()
+		e.sendMu.Unlock()
+		e.logger.Info("switched back to agent", "transport", preferred, "addr", e.addrs[preferred])
+
+		// Let the agent read what was sent through the fallback transport
+		// before closing it.
+		ctx, cancel := context.WithTimeout(context.Background(), streamCloseTimeout)
+		if n, err := e.closeStreams(ctx, old, oldMetrics, oldMetricsDone); err != nil {
+			e.onError(fmt.Errorf("%d spans sent to agent through %s may be lost: %v", n, oldProto, err))
+		}
+		cancel()
+		oldConn.Close()
+	}
 }
 
 // Start dials to the Hunter agent, establishing a connection to it.
 //
-// It performs a best case attempt to dial to the agent.
-// It retries dialing when fail happens with:
-//  * gRPC dialTimeout of 1s
-//  * exponential backoff, 5 times with a period of 50ms
-// hence in the worst case of (no agent actually available), it will take at least:
-//      (5 * 1s) + ((1<<5)-1) * 0.05 s = 5s + 1.55s = 6.55s
+// It performs a best case attempt to dial to the agent, trying proto first and
+// falling back to the other configured transports, and retries as configured
+// by DialRetry, see DefaultRetryPolicy.
 func (e *Exporter) Start(proto string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -159,93 +601,491 @@ func (e *Exporter) Start(proto string) error {
 	return err
 }
 
-// Stop shuts down the connection and resources related to the exporter.
-func (e *Exporter) Stop() error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// WaitReady blocks until the exporter is connected to the Hunter agent, ctx is
+// done or the exporter is stopped. It is mostly useful with NonBlocking.
+func (e *Exporter) WaitReady(ctx context.Context) error {
+	for {
+		e.mu.Lock()
+		stopped := e.stopped
+		connected := e.exportClient != nil
+		ready := e.ready
+		e.mu.Unlock()
 
-	if !e.started {
-		return errors.New("not started")
-	}
+		if stopped {
+			return errStopped
+		}
+		if connected {
+			return nil
+		}
 
-	if e.stopped {
-		return nil
+		select {
+		case <-ready:
+		case <-e.done:
+			return errStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	e.Flush()
+// Undelivered counts what the exporter could not deliver before shutting down.
+type Undelivered struct {
+	// Spans is the number of spans neither sent to the agent nor written
+	// to the spool.
+	Spans int
+	// Metrics is the number of metrics not sent to the agent.
+	Metrics int
+}
 
-	var err error
-	if e.clientConn != nil {
-		err = e.clientConn.Close()
+// Stop shuts down the connection and resources related to the exporter.
+// It is Shutdown without a deadline.
+func (e *Exporter) Stop() error {
+	_, err := e.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown flushes the buffered spans, waits for the agent to have read them,
+// then closes the connection and the resources related to the exporter. If
+// ctx is done before everything has been uploaded, Shutdown stops waiting and
+// returns what is left undelivered along with ctx.Err(). Spans sent to an
+// agent that has not confirmed reading them by then count as undelivered.
+//
+// Once Shutdown has been called the exporter is stopped for good: spans
+// exported afterwards are ignored and later calls return right away.
+func (e *Exporter) Shutdown(ctx context.Context) (Undelivered, error) {
+	e.mu.Lock()
+	if !e.started && !e.stopped {
+		e.mu.Unlock()
+		return Undelivered{}, errors.New("not started")
 	}
+	if !atomic.CompareAndSwapInt32(&e.closing, 0, 1) {
+		e.mu.Unlock()
+		return Undelivered{}, nil
+	}
+	e.mu.Unlock()
+
+	// NOTE: Flush without holding e.mu, uploadSpans needs it to get the stream.
+	_, err := e.FlushContext(ctx)
 
+	// From now on nothing is sent anymore: what is left goes to the spool,
+	// if any.
+	e.mu.Lock()
+	cc := e.clientConn
+	spans, metrics, metricsDone := e.exportClient, e.metricsClient, e.metricsDone
+	e.clientConn = nil
+	e.exportClient = nil
+	e.metricsClient = nil
+	e.metricsDone = nil
+	close(e.done)
 	e.started = false
 	e.stopped = true
+	e.setState(Shutdown)
+	e.mu.Unlock()
 
-	return err
+	unconfirmed, serr := e.closeStreams(ctx, spans, metrics, metricsDone)
+	if err == nil {
+		err = serr
+	}
+	if cc != nil {
+		// Makes any Send still in progress fail right away.
+		if cerr := cc.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if e.spool != nil {
+		spooled := make(chan error, 1)
+		go func() {
+			e.spoolRetryQueue()
+			spooled <- e.spool.close()
+		}()
+		select {
+		case serr := <-spooled:
+			if err == nil {
+				err = serr
+			}
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+
+	undelivered := e.undelivered()
+	undelivered.Spans += unconfirmed
+	return undelivered, err
 }
 
-// uploadSpans uploads a set of spans
-func (e *Exporter) uploadSpans(spans []*trace.SpanData) {
+// undelivered counts the spans and metrics not delivered yet.
+func (e *Exporter) undelivered() Undelivered {
+	return Undelivered{
+		Spans:   int(atomic.LoadInt64(&e.bundled)+atomic.LoadInt64(&e.inflight)) + e.queue.pendingSpans(),
+		Metrics: int(atomic.LoadInt64(&e.metricsBundled) + atomic.LoadInt64(&e.metricsInflight)),
+	}
+}
+
+// uploadSpans uploads a set of spans. The caller counts them in e.inflight
+// meanwhile, from before they leave the bundler, so that they are never
+// missing from Undelivered.
+func (e *Exporter) uploadSpans(spans []*spanBuf) {
 	if len(spans) == 0 {
 		return
 	}
 
-	req := &exporterproto.ExportSpanRequest{
-		Spans: make([]*traceproto.Span, 0, len(spans)),
+	// Each span fits in a request on its own, see fitSpan, but a batch may
+	// not: it is then split in as many requests as needed.
+	n := e.fitSpans(spans)
+	if n < len(spans) {
+		e.logger.Debug("batch exceeds the maximum message size, splitting",
+			"count", len(spans), "max", e.maxMessageSize)
+		stats.Record(context.Background(), BatchesSplit.M(1))
+		e.debugMu.Lock()
+		e.splitBatches++
+		e.debugMu.Unlock()
+	}
+	for len(spans) > 0 {
+		e.uploadBatch(spans[:n])
+		spans = spans[n:]
+		n = e.fitSpans(spans)
+	}
+}
+
+// uploadBatch uploads spans in a single request.
+func (e *Exporter) uploadBatch(spans []*spanBuf) {
+	req := getRequest(len(spans))
+	for _, span := range spans {
+		req.Spans = append(req.Spans, &span.span)
+	}
+	stats.Record(context.Background(), BatchSize.M(int64(len(req.Spans))))
+
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	err := e.replay()
+	if err == nil {
+		err = e.send(req)
+	}
+	if err != nil {
+		// The queue or spool now owns req and the buffers.
+		e.retryLater(req, err)
+		return
 	}
 
+	// Send has encoded req: its spans can be reused.
 	for _, span := range spans {
-		if span != nil {
-			req.Spans = append(req.Spans, toProtoSpan(span))
+		putSpanBuf(span)
+	}
+	putRequest(req)
+}
+
+// send writes req to the current stream. A failed Send means the stream is
+// broken, so reconnection is triggered before the error is returned.
+// e.sendMu must be held.
+func (e *Exporter) send(req *exporterproto.ExportSpanRequest) error {
+	e.mu.Lock()
+	stream := e.exportClient
+	e.mu.Unlock()
+
+	if stream == nil {
+		return errNoConnection
+	}
+
+	start := time.Now()
+	err := stream.Send(e.dedupStacks(stream, req))
+	recordSend(len(req.Spans), start, err == nil)
+	if err != nil {
+		e.reconnect(stream)
+		return err
+	}
+	atomic.AddInt64(&stream.sent, int64(len(req.Spans)))
+	return nil
+}
+
+// replay resends the queued batches in order, stopping at the first one that
+// fails. e.sendMu must be held.
+func (e *Exporter) replay() error {
+	for _, req := range e.queue.expire(time.Now()) {
+		e.spill(req, "retry queue timeout")
+	}
+
+	for req := e.queue.front(); req != nil; req = e.queue.front() {
+		if err := e.send(req); err != nil {
+			return err
 		}
+		e.queue.pop()
+	}
+	return nil
+}
+
+// retryLater queues req, whose upload failed with err, for resending.
+// e.sendMu must be held.
+func (e *Exporter) retryLater(req *exporterproto.ExportSpanRequest, err error) {
+	if err == io.EOF || err == errNoConnection {
+		e.logger.Debug("connection is unavailable, queueing spans for retry", "count", len(req.Spans))
+	} else {
+		e.onError(err)
+	}
+
+	for _, r := range e.queue.push(req) {
+		e.spill(r, "retry queue full")
+	}
+}
+
+// spill writes req, evicted from the retry queue for reason, to the spool.
+// Without a spool, req is dropped.
+func (e *Exporter) spill(req *exporterproto.ExportSpanRequest, reason string) {
+	if e.spool == nil {
+		e.dropSpans(len(req.Spans), reason)
+		return
+	}
+
+	b, err := proto.Marshal(req)
+	if err != nil {
+		e.onError(err)
+		e.dropSpans(len(req.Spans), "cannot serialize batch for spool")
+		return
+	}
+
+	dropped, err := e.spool.write(b)
+	e.dropSpans(dropped, "spool full")
+	if err != nil {
+		e.onError(err)
+		e.dropSpans(len(req.Spans), "cannot write batch to spool")
+	}
+}
+
+// spoolRetryQueue moves whatever is left in the retry queue to the spool, so
+// that it survives the process exiting.
+func (e *Exporter) spoolRetryQueue() {
+	if e.spool == nil {
+		return
+	}
+
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	for req := e.queue.front(); req != nil; req = e.queue.front() {
+		e.spill(req, "exporter stopped")
+		e.queue.pop()
+	}
+}
+
+// kickSpool wakes up drainSpool, if the spool is enabled.
+func (e *Exporter) kickSpool() {
+	if e.spool == nil {
+		return
+	}
+	select {
+	case e.spoolKick <- struct{}{}:
+	default:
 	}
+}
+
+// drainSpool replays the spool each time it is kicked, until the exporter is
+// stopped.
+func (e *Exporter) drainSpool() {
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-e.spoolKick:
+		}
 
-	if err := e.exportClient.Send(req); err != nil {
-		if err == io.EOF {
-			e.logger.Println("Connection is unavailable, LOST current Span...")
-		} else {
-			e.onError(err)
+		for e.replaySpooled() {
 		}
 	}
 }
 
+// replaySpooled sends the oldest spooled batch, and reports whether there
+// may be more to send.
+func (e *Exporter) replaySpooled() bool {
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	rec, err := e.spool.next()
+	if err != nil {
+		e.onError(err)
+		return true
+	}
+	if rec == nil {
+		return false
+	}
+
+	req := &exporterproto.ExportSpanRequest{}
+	if err := proto.Unmarshal(rec.payload, req); err != nil {
+		e.onError(fmt.Errorf("spool: skipped unreadable batch: %v", err))
+		e.spool.commit(rec)
+		return true
+	}
+
+	if err := e.send(req); err != nil {
+		// Keep it spooled, the next reconnection kicks the drain again.
+		return false
+	}
+	e.spool.commit(rec)
+	return true
+}
+
+// flushRetryQueue resends the queued batches, e.g. once reconnected.
+func (e *Exporter) flushRetryQueue() {
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	e.replay()
+}
+
+// dropSpans reports n spans as permanently lost.
+func (e *Exporter) dropSpans(n int, reason string) {
+	if n > 0 {
+		e.countDropped(n, reason)
+		e.onError(&DroppedSpansError{Count: n, Reason: reason})
+	}
+}
+
+// countDropped accounts for n spans dropped for reason, in the self-telemetry
+// and on the debug page.
+func (e *Exporter) countDropped(n int, reason string) {
+	recordDropped(n, reason)
+
+	e.debugMu.Lock()
+	e.droppedSpans[reason] += int64(n)
+	e.debugMu.Unlock()
+}
+
 // ExportSpan exports spans to Hunter agent.
 func (e *Exporter) ExportSpan(s *trace.SpanData) {
-	n := 1
-	n += len(s.Attributes)
-	n += len(s.Annotations)
-	n += len(s.MessageEvents)
-	err := e.bundler.Add(s, n)
+	if atomic.LoadInt32(&e.closing) != 0 {
+		return
+	}
+	stats.Record(context.Background(), SpansReceived.M(1))
+
+	e.children.add(s)
+
+	// Spans are converted right away, so that the bundler accounts for
+	// their encoded size and does not keep the SpanData alive.
+	buf := getSpanBuf()
+	sp := e.conv.toProtoSpan(buf, s)
+	sp.StackTrace = takeStack(s.SpanID)
+	if sp.StackTrace == nil && e.captureStacksOnError && s.Code != 0 {
+		sp.StackTrace = captureStack(2)
+	}
+	buf.children.Value = e.children.take(s.SpanID)
+	sp.ChildSpanCount = &buf.children
+	buf.size = proto.Size(sp)
+	if !e.fitSpan(buf) {
+		e.dropSpans(1, reasonTooLarge)
+		putSpanBuf(buf)
+		return
+	}
+
+	// Spans larger than a bundle are uploaded on their own, bypassing the
+	// bundler: they are counted in oversizedBytes, and the spans in the
+	// bundler and those together are held to BufferedByteLimit.
+	size := int64(buf.size)
+	limit := int64(e.bundler.BufferedByteLimit)
+	var err error
+	if buf.size > e.bundler.BundleByteLimit {
+		if atomic.AddInt64(&e.oversizedBytes, size)+atomic.LoadInt64(&e.bundledBytes) <= limit {
+			atomic.AddInt64(&e.inflight, 1)
+			e.oversized.add()
+			go func() {
+				defer e.oversized.done()
+				e.uploadSpans([]*spanBuf{buf})
+				atomic.AddInt64(&e.inflight, -1)
+				atomic.AddInt64(&e.oversizedBytes, -size)
+			}()
+			return
+		}
+		atomic.AddInt64(&e.oversizedBytes, -size)
+		err = bundler.ErrOverflow
+	} else if atomic.LoadInt64(&e.bundledBytes)+atomic.LoadInt64(&e.oversizedBytes)+size > limit {
+		err = bundler.ErrOverflow
+	} else {
+		atomic.AddInt64(&e.bundled, 1)
+		atomic.AddInt64(&e.bundledBytes, size)
+		err = e.bundler.Add(buf, buf.size)
+		if err != nil {
+			atomic.AddInt64(&e.bundled, -1)
+			atomic.AddInt64(&e.bundledBytes, -size)
+		}
+	}
 	switch err {
 	case nil:
 		return
-	case bundler.ErrOversizedItem:
-		go e.uploadSpans([]*trace.SpanData{s})
 	case bundler.ErrOverflow:
+		e.countDropped(1, reasonOverflow)
 		e.overflowLogger.log()
 	default:
 		e.onError(err)
 	}
+	putSpanBuf(buf)
 }
 
-// ExportView exports the view data.
+// ExportView exports the view data to Hunter agent, as a metric.
 func (e *Exporter) ExportView(vd *view.Data) {
-	log.Println("---> ExportView:", vd)
+	if atomic.LoadInt32(&e.closing) != 0 {
+		return
+	}
+
+	m := toProtoMetric(vd)
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&e.metricsBundled, 1)
+	err := e.metricsBundler.Add(m, proto.Size(m))
+	if err != nil {
+		atomic.AddInt64(&e.metricsBundled, -1)
+	}
+	switch err {
+	case nil:
+		return
+	case bundler.ErrOversizedItem:
+		go e.uploadMetrics([]*metricsproto.Metric{m})
+	default:
+		e.dropMetrics(1, err.Error())
+	}
 }
 
 func (e *Exporter) onError(err error) {
-	if e.onError != nil {
-		e.onError(err)
+	e.debugMu.Lock()
+	e.lastErr = err
+	e.lastErrTime = time.Now()
+	e.debugMu.Unlock()
+
+	if e.options.onError != nil {
+		e.options.onError(err)
 		return
 	}
-	log.Printf("Fail: %v", err)
+	e.logger.Error("exporter error", "err", err)
 }
 
-// Flush waits for exported trace spans to be uploaded.
+// Flush waits for exported trace spans and view data to be uploaded.
 //
 // This is useful if your program is ending and you do not want to lose recent
 // spans.
 func (e *Exporter) Flush() {
-	e.bundler.Flush()
+	e.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but gives up waiting when ctx is done, in which
+// case it returns what is left undelivered along with ctx.Err(). The upload
+// itself goes on in the background: each call that gives up leaves its flush
+// goroutine running until the upload ends.
+func (e *Exporter) FlushContext(ctx context.Context) (Undelivered, error) {
+	flushed := make(chan struct{})
+	go func() {
+		e.bundler.Flush()
+		e.oversized.wait()
+		e.flushRetryQueue()
+		e.metricsBundler.Flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return e.undelivered(), nil
+	case <-ctx.Done():
+		return e.undelivered(), ctx.Err()
+	}
 }
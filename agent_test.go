@@ -1 +1,525 @@
 package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+)
+
+// fakeAgent is a Hunter agent recording the names of the spans it reads.
+type fakeAgent struct {
+	network, addr string
+	srv           *grpc.Server
+
+	mu      sync.Mutex
+	spans   []string
+	metrics int
+	// hold, if not nil, keeps the agent from reading the streams until it
+	// is closed.
+	hold chan struct{}
+}
+
+// startFakeAgent starts an agent listening on the tcp address addr,
+// "127.0.0.1:0" for any port.
+func startFakeAgent(t *testing.T, addr string) *fakeAgent {
+	t.Helper()
+	return listenFakeAgent(t, "tcp", addr)
+}
+
+func listenFakeAgent(t *testing.T, network, addr string) *fakeAgent {
+	t.Helper()
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &fakeAgent{network: network, addr: lis.Addr().String(), srv: grpc.NewServer()}
+	exporterproto.RegisterExportServer(a.srv, a)
+	go a.srv.Serve(lis)
+	return a
+}
+
+// restart starts a new agent on the address of a, once stopped.
+func (a *fakeAgent) restart(t *testing.T) *fakeAgent {
+	t.Helper()
+	b := listenFakeAgent(t, a.network, a.addr)
+	a.mu.Lock()
+	b.spans = append(b.spans, a.spans...)
+	a.mu.Unlock()
+	return b
+}
+
+func (a *fakeAgent) stop() {
+	a.srv.Stop()
+}
+
+func (a *fakeAgent) wait() {
+	a.mu.Lock()
+	hold := a.hold
+	a.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+}
+
+func (a *fakeAgent) ExportSpan(stream exporterproto.Export_ExportSpanServer) error {
+	a.wait()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		for _, sp := range req.Spans {
+			a.spans = append(a.spans, sp.GetName().GetValue())
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *fakeAgent) ExportMetrics(stream exporterproto.Export_ExportMetricsServer) error {
+	a.wait()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.metrics += len(req.Metrics)
+		a.mu.Unlock()
+	}
+}
+
+// received returns the names of the spans read so far, in order.
+func (a *fakeAgent) received() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.spans...)
+}
+
+// waitFor polls cond until it holds, failing the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testRetry retries dialing quickly and forever.
+var testRetry = DialRetry(RetryPolicy{
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    50 * time.Millisecond,
+	DialTimeout: 200 * time.Millisecond,
+})
+
+func newTestExporter(t *testing.T, addr string, opt ...ExporterOption) *Exporter {
+	t.Helper()
+	opts := append([]ExporterOption{
+		OnlyAddrs(map[string]string{"tcp": addr}),
+		LeveledLogger(NopLogger()),
+		ErrFun(func(error) {}),
+		testRetry,
+	}, opt...)
+	e, err := NewExporter(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+var testSpanID uint64
+
+// testSpan returns a sampled span named name, padded to at least size bytes.
+func testSpan(name string, size int) *trace.SpanData {
+	testSpanID++
+	start := time.Now()
+	if pad := size - len(name); pad > 0 {
+		name += "-" + strings.Repeat("x", pad)
+	}
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID:      trace.TraceID{1},
+			SpanID:       spanID(testSpanID),
+			TraceOptions: 1,
+		},
+		Name:      name,
+		StartTime: start,
+		EndTime:   start.Add(time.Millisecond),
+	}
+}
+
+func exportSpans(e *Exporter, prefix string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%d", prefix, i)
+		e.ExportSpan(testSpan(names[i], 0))
+	}
+	return names
+}
+
+func checkReceived(t *testing.T, a *fakeAgent, want []string) {
+	t.Helper()
+	if got := a.received(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("agent received %d spans %v, want %d %v", len(got), got, len(want), want)
+	}
+}
+
+func TestShutdownDeliversEverything(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	defer a.stop()
+	e := newTestExporter(t, a.addr)
+
+	want := exportSpans(e, "span", 50)
+	undelivered, err := e.Shutdown(context.Background())
+	if err != nil || undelivered != (Undelivered{}) {
+		t.Errorf("Shutdown() = %+v, %v; want nothing undelivered", undelivered, err)
+	}
+	// Shutdown waited for the agent to read everything.
+	checkReceived(t, a, want)
+}
+
+func TestShutdownExpired(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	defer a.stop()
+	hold := make(chan struct{})
+	defer close(hold)
+	a.mu.Lock()
+	a.hold = hold
+	a.mu.Unlock()
+	e := newTestExporter(t, a.addr)
+
+	exportSpans(e, "span", 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	undelivered, err := e.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The spans were sent, but the agent never read them.
+	if undelivered.Spans != 10 {
+		t.Errorf("Shutdown() undelivered %d spans, want 10", undelivered.Spans)
+	}
+}
+
+func TestFlushContextUndelivered(t *testing.T) {
+	e := newTestExporter(t, "127.0.0.1:1", NonBlocking())
+	defer e.Shutdown(context.Background())
+
+	exportSpans(e, "span", 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// Without an agent, the spans wait in the retry queue.
+	undelivered, err := e.FlushContext(ctx)
+	if err != nil || undelivered.Spans != 3 {
+		t.Errorf("FlushContext() = %+v, %v; want 3 spans undelivered", undelivered, err)
+	}
+}
+
+func TestFlushContextWaitsForOversizedSpans(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	defer a.stop()
+	// Spans of 200 bytes are too large for a bundle, each is uploaded on
+	// its own.
+	e := newTestExporter(t, a.addr, ByteThreshold(100))
+	defer e.Shutdown(context.Background())
+
+	// While a span waits to be sent, it is undelivered.
+	e.sendMu.Lock()
+	e.ExportSpan(testSpan("blocked", 200))
+	if got := e.undelivered().Spans; got != 1 {
+		t.Errorf("%d spans undelivered while uploading, want 1", got)
+	}
+	e.sendMu.Unlock()
+
+	for i := 0; i < 20; i++ {
+		e.ExportSpan(testSpan(fmt.Sprintf("span-%d", i), 200))
+	}
+	undelivered, err := e.FlushContext(context.Background())
+	if err != nil || undelivered != (Undelivered{}) {
+		t.Errorf("FlushContext() = %+v, %v; want nothing undelivered", undelivered, err)
+	}
+	e.mu.Lock()
+	stream := e.exportClient
+	e.mu.Unlock()
+	if sent := atomic.LoadInt64(&stream.sent); sent != 21 {
+		t.Errorf("%d spans sent once flushed, want 21", sent)
+	}
+}
+
+// transport returns the transport the exporter is connected through.
+func transport(e *Exporter) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.proto
+}
+
+func TestSwitchBackToPreferredTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hunter-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "agent.sock")
+
+	tcp := startFakeAgent(t, "127.0.0.1:0")
+	defer tcp.stop()
+	e := newTestExporter(t, "", OnlyAddrs(map[string]string{"unix": socket, "tcp": tcp.addr}),
+		ProbeInterval(10*time.Millisecond))
+
+	// Keep sending while the exporter switches to the unix socket once it
+	// is available: nothing sent through tcp right before is lost.
+	var want []string
+	var unix *fakeAgent
+	for i := 0; i < 20 || transport(e) != "unix"; i++ {
+		if i == 10 {
+			unix = listenFakeAgent(t, "unix", socket)
+			defer unix.stop()
+		}
+		if i > 1000 {
+			t.Fatal("never switched to the unix socket")
+		}
+		name := fmt.Sprintf("span-%d", i)
+		want = append(want, name)
+		e.ExportSpan(testSpan(name, 0))
+		e.FlushContext(context.Background())
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := append(tcp.received(), unix.received()...)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("agents received %v through tcp and %v through unix, want %v", tcp.received(), unix.received(), want)
+	}
+	if len(unix.received()) == 0 {
+		t.Error("nothing sent through the unix socket")
+	}
+}
+
+func TestReconnectAfterAgentRestart(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	e := newTestExporter(t, a.addr)
+
+	want := exportSpans(e, "before", 5)
+	e.FlushContext(context.Background())
+	waitFor(t, "the first batch", func() bool { return len(a.received()) == 5 })
+
+	a.stop()
+	waitFor(t, "the broken stream to be noticed", func() bool { return e.State() != Ready })
+	// Spans exported while the agent is down are held for retry.
+	want = append(want, exportSpans(e, "down", 5)...)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if undelivered, _ := e.FlushContext(ctx); undelivered.Spans != 5 {
+		t.Errorf("%d spans undelivered while the agent is down, want 5", undelivered.Spans)
+	}
+
+	a = a.restart(t)
+	defer a.stop()
+	waitFor(t, "the held batch", func() bool { return len(a.received()) == len(want) })
+	want = append(want, exportSpans(e, "after", 5)...)
+	if _, err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, a, want)
+}
+
+// freeAddr returns a local tcp address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestNonBlockingWaitReady(t *testing.T) {
+	addr := freeAddr(t)
+	e := newTestExporter(t, addr, NonBlocking(), DelayThreshold(10*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := e.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitReady() without agent = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Spans exported before the connection are held until then.
+	want := exportSpans(e, "early", 3)
+
+	a := startFakeAgent(t, addr)
+	defer a.stop()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() = %v, want nil", err)
+	}
+	waitFor(t, "the held spans", func() bool { return len(a.received()) == len(want) })
+
+	if _, err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, a, want)
+	if err := e.WaitReady(context.Background()); err != errStopped {
+		t.Errorf("WaitReady() after Shutdown = %v, want %v", err, errStopped)
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	var mu sync.Mutex
+	var changes []string
+	onChange := func(old, new State) {
+		mu.Lock()
+		changes = append(changes, fmt.Sprintf("%v->%v", old, new))
+		mu.Unlock()
+	}
+	delivered := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), changes...)
+	}
+
+	a := startFakeAgent(t, "127.0.0.1:0")
+	e := newTestExporter(t, a.addr, OnStateChange(onChange))
+	if got := e.State(); got != Ready {
+		t.Errorf("State() once connected = %v, want %v", got, Ready)
+	}
+
+	a.stop()
+	waitFor(t, "the broken stream to be noticed", func() bool { return e.State() != Ready })
+	a = a.restart(t)
+	defer a.stop()
+	waitFor(t, "the reconnection", func() bool { return e.State() == Ready })
+
+	if _, err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.State(); got != Shutdown {
+		t.Errorf("State() after Shutdown = %v, want %v", got, Shutdown)
+	}
+	// The hook is called in order, up to the transition to Shutdown.
+	waitFor(t, "the transition to Shutdown", func() bool {
+		got := delivered()
+		return len(got) > 0 && strings.HasSuffix(got[len(got)-1], "SHUTDOWN")
+	})
+	want := "[CONNECTING->READY READY->CONNECTING CONNECTING->READY READY->SHUTDOWN]"
+	if got := fmt.Sprint(delivered()); got != want {
+		t.Errorf("state changes %s, want %s", got, want)
+	}
+}
+
+func droppedSpans(e *Exporter, reason string) int64 {
+	e.debugMu.Lock()
+	defer e.debugMu.Unlock()
+	return e.droppedSpans[reason]
+}
+
+// checkBuffered checks the spans counted as waiting in the bundler, and
+// the bytes of these and of the oversized spans being uploaded.
+func checkBuffered(t *testing.T, e *Exporter, bundled, bundledBytes, oversizedBytes int64) {
+	t.Helper()
+	got := [3]int64{atomic.LoadInt64(&e.bundled), atomic.LoadInt64(&e.bundledBytes), atomic.LoadInt64(&e.oversizedBytes)}
+	if want := [3]int64{bundled, bundledBytes, oversizedBytes}; got != want {
+		t.Errorf("bundled, bundledBytes, oversizedBytes = %v, want %v", got, want)
+	}
+}
+
+func TestBufferedByteLimit(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	defer a.stop()
+
+	// The size of a span as bundled, give or take the varints of its
+	// timestamps.
+	e := newTestExporter(t, a.addr)
+	e.ExportSpan(testSpan("span", 0))
+	size := atomic.LoadInt64(&e.bundledBytes)
+	e.Shutdown(context.Background())
+
+	// Room for 3 spans.
+	e = newTestExporter(t, a.addr, BufferedByteLimit(int(3*size+size/2)), DelayThreshold(time.Hour))
+	defer e.Shutdown(context.Background())
+	for i := 0; i < 5; i++ {
+		e.ExportSpan(testSpan("span", 0))
+	}
+	if got := droppedSpans(e, reasonOverflow); got != 2 {
+		t.Errorf("%d spans dropped for overflow, want 2", got)
+	}
+	if got := atomic.LoadInt64(&e.bundled); got != 3 {
+		t.Errorf("%d spans bundled, want 3", got)
+	}
+
+	undelivered, err := e.FlushContext(context.Background())
+	if err != nil || undelivered != (Undelivered{}) {
+		t.Errorf("FlushContext() = %+v, %v; want nothing undelivered", undelivered, err)
+	}
+	checkBuffered(t, e, 0, 0, 0)
+	if got := atomic.LoadInt64(&e.inflight); got != 0 {
+		t.Errorf("%d spans inflight once flushed, want 0", got)
+	}
+}
+
+func TestBufferedByteLimitOversized(t *testing.T) {
+	a := startFakeAgent(t, "127.0.0.1:0")
+	defer a.stop()
+	// Spans named with 200 bytes bypass the bundler, there is room for 2
+	// of them.
+	e := newTestExporter(t, a.addr, ByteThreshold(100), BufferedByteLimit(600))
+	defer e.Shutdown(context.Background())
+
+	// Keep the uploads from sending anything.
+	e.sendMu.Lock()
+	for i := 0; i < 3; i++ {
+		e.ExportSpan(testSpan("large", 200))
+	}
+	if got := droppedSpans(e, reasonOverflow); got != 1 {
+		t.Errorf("%d spans dropped for overflow, want 1", got)
+	}
+	oversized := atomic.LoadInt64(&e.oversizedBytes)
+	if oversized <= 2*200 || oversized > 600 {
+		t.Errorf("oversizedBytes = %d while uploading 2 spans, want in (400, 600]", oversized)
+	}
+	// Spans waiting in the bundler share the limit: there is no room left
+	// for a small one.
+	e.ExportSpan(testSpan("small", 0))
+	if got := droppedSpans(e, reasonOverflow); got != 2 {
+		t.Errorf("%d spans dropped for overflow, want 2", got)
+	}
+	e.sendMu.Unlock()
+
+	if _, err := e.FlushContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkBuffered(t, e, 0, 0, 0)
+	// Once uploaded, they make room again.
+	e.ExportSpan(testSpan("large", 200))
+	if got := droppedSpans(e, reasonOverflow); got != 2 {
+		t.Errorf("%d spans dropped for overflow after the upload, want 2", got)
+	}
+	e.FlushContext(context.Background())
+	waitFor(t, "the spans", func() bool { return len(a.received()) == 3 })
+}
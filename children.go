@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"container/list"
+	"sync"
+
+	"go.opencensus.io/trace"
+)
+
+// maxTrackedParents bounds the number of parent spans childCounts keeps a
+// count for.
+const maxTrackedParents = 8192
+
+// childCounts counts the children of spans as they are exported. Children
+// usually end, hence are exported, before their parent: by the time a span
+// is exported, the count holds its children ended in this process so far.
+// Children ending after their parent are not accounted for.
+type childCounts struct {
+	mu     sync.Mutex
+	counts map[trace.SpanID]*list.Element
+	order  *list.List // of *childCount, oldest first, to evict parents never exported
+}
+
+type childCount struct {
+	parent trace.SpanID
+	n      uint32
+}
+
+func newChildCounts() *childCounts {
+	return &childCounts{
+		counts: make(map[trace.SpanID]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// add counts s as a child of its parent, if the parent is in this process.
+func (c *childCounts) add(s *trace.SpanData) {
+	if s.ParentSpanID == (trace.SpanID{}) || s.HasRemoteParent {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.counts[s.ParentSpanID]
+	if !ok {
+		if c.order.Len() >= maxTrackedParents {
+			oldest := c.order.Remove(c.order.Front()).(*childCount)
+			delete(c.counts, oldest.parent)
+		}
+		el = c.order.PushBack(&childCount{parent: s.ParentSpanID})
+		c.counts[s.ParentSpanID] = el
+	}
+	el.Value.(*childCount).n++
+}
+
+// take returns the number of children counted for the span id, and forgets
+// it.
+func (c *childCounts) take(id trace.SpanID) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.counts[id]
+	if !ok {
+		return 0
+	}
+	delete(c.counts, id)
+	return c.order.Remove(el).(*childCount).n
+}
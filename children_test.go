@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func childOf(parent uint64) *trace.SpanData {
+	s := &trace.SpanData{}
+	binary.BigEndian.PutUint64(s.ParentSpanID[:], parent)
+	return s
+}
+
+func spanID(id uint64) trace.SpanID {
+	var sid trace.SpanID
+	binary.BigEndian.PutUint64(sid[:], id)
+	return sid
+}
+
+func TestChildCounts(t *testing.T) {
+	c := newChildCounts()
+	for _, parent := range []uint64{1, 2, 1, 1} {
+		c.add(childOf(parent))
+	}
+	remote := childOf(3)
+	remote.HasRemoteParent = true
+	c.add(remote)
+	c.add(&trace.SpanData{})
+
+	for _, tt := range []struct {
+		id   uint64
+		want uint32
+	}{
+		{1, 3},
+		{1, 0}, // taken
+		{2, 1},
+		{3, 0},
+		{0, 0},
+	} {
+		if got := c.take(spanID(tt.id)); got != tt.want {
+			t.Errorf("take(%d) = %d, want %d", tt.id, got, tt.want)
+		}
+	}
+	if len(c.counts) != 0 || c.order.Len() != 0 {
+		t.Errorf("%d counts, %d in order after taking all, want none", len(c.counts), c.order.Len())
+	}
+}
+
+func TestChildCountsEviction(t *testing.T) {
+	c := newChildCounts()
+	for id := uint64(1); id <= maxTrackedParents; id++ {
+		c.add(childOf(id))
+	}
+	// Taken parents make room without evicting.
+	c.take(spanID(2))
+	c.add(childOf(maxTrackedParents + 1))
+	if got := c.take(spanID(1)); got != 1 {
+		t.Errorf("take(1) = %d, want 1", got)
+	}
+
+	// The first new parent takes the room of 1, the second evicts 3, now the
+	// oldest. Counting for a parent already tracked evicts nothing.
+	c.add(childOf(maxTrackedParents + 2))
+	c.add(childOf(maxTrackedParents + 3))
+	c.add(childOf(4))
+	if got := c.take(spanID(3)); got != 0 {
+		t.Errorf("take(3) = %d after eviction, want 0", got)
+	}
+	if got := c.take(spanID(4)); got != 2 {
+		t.Errorf("take(4) = %d, want 2", got)
+	}
+	if len(c.counts) != c.order.Len() || len(c.counts) > maxTrackedParents {
+		t.Errorf("%d counts, %d in order, want equal and at most %d", len(c.counts), c.order.Len(), maxTrackedParents)
+	}
+}
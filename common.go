@@ -3,41 +3,87 @@ package agent
 import (
 	"errors"
 	"math/rand"
+	"sync"
 	"time"
 )
 
-var randSrc = rand.New(rand.NewSource(time.Now().UnixNano()))
+var (
+	randMu  sync.Mutex
+	randSrc = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randDuration returns a pseudo-random duration in [0, max).
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return time.Duration(randSrc.Int63n(int64(max)))
+}
 
-// retryWithExponentialBackoff retries fn() up to n times at most, if fn() returns an error,
-// then it returns nil right away.
-// It applies exponential backoff in units of (1<<n) + jitter microsends.
-func retryWithExponentialBackoff(nTries int64, timeBaseUnit time.Duration, fn func() error) (err error) {
-	for i := int64(0); i < nTries; i++ {
+// retry calls fn() until it returns nil, applying exponential backoff between
+// attempts, and gives up once p.MaxAttempts or p.MaxElapsedTime is reached or
+// done is closed. It returns the last error of fn().
+func (p *RetryPolicy) retry(done <-chan struct{}, fn func() error) (err error) {
+	start := time.Now()
+	for i := 0; p.MaxAttempts <= 0 || i < p.MaxAttempts; i++ {
 		err = fn()
 		if err == nil {
 			return nil
 		}
+		if p.MaxAttempts > 0 && i == p.MaxAttempts-1 {
+			break
+		}
+
 		// Backoff for a time period with a pseudo-random jitter
-		jitter := time.Duration(randSrc.Float64()*100) * time.Microsecond
-		ts := jitter + ((1 << uint64(i)) * timeBaseUnit)
-		<-time.After(ts)
+		d := p.delay(i)
+		if p.MaxElapsedTime > 0 && time.Since(start)+d > p.MaxElapsedTime {
+			break
+		}
+		select {
+		case <-done:
+			return err
+		case <-time.After(d):
+		}
 	}
 	return err
 }
 
-func preferedAddr(o *options) (string, error) {
-	// NOTE: unix domain socket is preferred
-	var preferred string
-	if _, ok := o.addrs["tcp"]; ok {
-		preferred = "tcp"
+// delay returns the period to wait after the n-th (0 based) failed attempt:
+// (1<<n) units of p.BaseDelay, capped at p.MaxDelay, with jitter applied.
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	switch p.Jitter {
+	case FullJitter:
+		return randDuration(d)
+	case EqualJitter:
+		return d/2 + randDuration(d-d/2)
+	default:
+		return d + randDuration(100*time.Microsecond)
 	}
-	if _, ok := o.addrs["unix"]; ok {
-		preferred = "unix"
+}
+
+// endpointOrder returns the transports configured in o, most preferred first.
+func endpointOrder(o *options) ([]string, error) {
+	// NOTE: unix domain socket is preferred
+	var order []string
+	for _, proto := range []string{"unix", "tcp"} {
+		if _, ok := o.addrs[proto]; ok {
+			order = append(order, proto)
+		}
 	}
 
-	if preferred == "" {
-		return "", errors.New("find no addrs")
+	if len(order) == 0 {
+		return nil, errors.New("find no addrs")
 	}
 
-	return preferred, nil
+	return order, nil
 }
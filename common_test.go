@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		n      int
+		// The delay is in [min, max).
+		min, max time.Duration
+	}{
+		{"first", RetryPolicy{BaseDelay: 10 * ms}, 0, 10 * ms, 10*ms + 100*time.Microsecond},
+		{"doubled", RetryPolicy{BaseDelay: 10 * ms}, 3, 80 * ms, 80*ms + 100*time.Microsecond},
+		{"capped", RetryPolicy{BaseDelay: 10 * ms, MaxDelay: 50 * ms}, 3, 50 * ms, 50*ms + 100*time.Microsecond},
+		{"capped base", RetryPolicy{BaseDelay: 10 * ms, MaxDelay: 5 * ms}, 0, 5 * ms, 5*ms + 100*time.Microsecond},
+		// The doubling stops at the cap instead of overflowing.
+		{"many attempts", RetryPolicy{BaseDelay: 10 * ms, MaxDelay: time.Second}, 1000, time.Second, time.Second + 100*time.Microsecond},
+		{"full jitter", RetryPolicy{BaseDelay: 10 * ms, Jitter: FullJitter}, 2, 0, 40 * ms},
+		{"full jitter capped", RetryPolicy{BaseDelay: 10 * ms, MaxDelay: 30 * ms, Jitter: FullJitter}, 2, 0, 30 * ms},
+		{"equal jitter", RetryPolicy{BaseDelay: 10 * ms, Jitter: EqualJitter}, 2, 20 * ms, 40 * ms},
+		{"equal jitter capped", RetryPolicy{BaseDelay: 10 * ms, MaxDelay: 30 * ms, Jitter: EqualJitter}, 2, 15 * ms, 30 * ms},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := tt.policy.delay(tt.n); d < tt.min || d >= tt.max {
+				t.Errorf("%s: delay(%d) = %v, want in [%v, %v)", tt.name, tt.n, d, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+var errRetryTest = errors.New("failed")
+
+// failingUntil returns a function failing until its n-th call, or always if
+// n is 0, and a pointer to the number of calls made.
+func failingUntil(n int) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if n == 0 || calls < n {
+			return errRetryTest
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		// succeed is the call fn succeeds at, 0 for never.
+		succeed   int
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", RetryPolicy{MaxAttempts: 3}, 1, 1, nil},
+		{"success after retries", RetryPolicy{MaxAttempts: 3}, 3, 3, nil},
+		{"max attempts", RetryPolicy{MaxAttempts: 3}, 0, 3, errRetryTest},
+		{"single attempt", RetryPolicy{MaxAttempts: 1}, 0, 1, errRetryTest},
+		// MaxAttempts 0 retries until fn succeeds.
+		{"unlimited", RetryPolicy{BaseDelay: time.Nanosecond, MaxDelay: time.Nanosecond}, 50, 50, nil},
+		// The next delay would end after MaxElapsedTime: give up without waiting.
+		{"max elapsed time", RetryPolicy{BaseDelay: time.Hour, MaxElapsedTime: time.Minute}, 0, 1, errRetryTest},
+	}
+	for _, tt := range tests {
+		fn, calls := failingUntil(tt.succeed)
+		start := time.Now()
+		err := tt.policy.retry(nil, fn)
+		if err != tt.wantErr {
+			t.Errorf("%s: retry() = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if *calls != tt.wantCalls {
+			t.Errorf("%s: %d calls, want %d", tt.name, *calls, tt.wantCalls)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: retry() took %v", tt.name, elapsed)
+		}
+	}
+}
+
+func TestRetryPolicyRetryDone(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	fn, calls := failingUntil(0)
+
+	p := RetryPolicy{BaseDelay: time.Hour}
+	if err := p.retry(done, fn); err != errRetryTest {
+		t.Errorf("retry() = %v, want %v", err, errRetryTest)
+	}
+	if *calls != 1 {
+		t.Errorf("%d calls, want 1", *calls)
+	}
+}
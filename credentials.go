@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// transportCredentials builds the TLS credentials used for the tcp endpoint
+// from the certificate material in o. It returns nil if TLS is not enabled.
+func transportCredentials(o *options) (credentials.TransportCredentials, error) {
+	if o.tlsServerCA == "" && o.tlsClientCert == "" && o.tlsClientKey == "" {
+		if o.tlsServerName != "" {
+			return nil, fmt.Errorf("TLS server name %q set without a server CA or client certificate", o.tlsServerName)
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName: o.tlsServerName,
+	}
+
+	if o.tlsServerCA != "" {
+		pem, err := ioutil.ReadFile(o.tlsServerCA)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS server CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid PEM certificate found in TLS server CA %s", o.tlsServerCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.tlsClientCert != "" || o.tlsClientKey != "" {
+		if o.tlsClientCert == "" || o.tlsClientKey == "" {
+			return nil, fmt.Errorf("TLS client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(o.tlsClientCert, o.tlsClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(cfg), nil
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir, and
+// returns their paths.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestTransportCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hunter-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+	badPEM := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(badPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name    string
+		opt     []ExporterOption
+		wantTLS bool
+		wantErr bool
+	}{
+		{"no TLS", nil, false, false},
+		{"server name without TLS material", []ExporterOption{ServerNameOverride("agent")}, false, true},
+		{"server CA", []ExporterOption{ServerCA(cert)}, true, false},
+		{"server CA and name", []ExporterOption{ServerCA(cert), ServerNameOverride("agent")}, true, false},
+		{"missing server CA", []ExporterOption{ServerCA(missing)}, false, true},
+		{"bad server CA PEM", []ExporterOption{ServerCA(badPEM)}, false, true},
+		{"client cert", []ExporterOption{ClientCert(cert, key)}, true, false},
+		{"client cert without key", []ExporterOption{ClientCert(cert, "")}, false, true},
+		{"client key without cert", []ExporterOption{ClientCert("", key)}, false, true},
+		{"client cert with a bad key", []ExporterOption{ClientCert(cert, badPEM)}, false, true},
+		{"mutual TLS", []ExporterOption{ServerCA(cert), ClientCert(cert, key)}, true, false},
+	}
+	for _, tt := range tests {
+		o := newOptions(tt.opt...)
+		creds, err := transportCredentials(&o)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: transportCredentials() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if (creds != nil) != tt.wantTLS {
+			t.Errorf("%s: transportCredentials() = %v, want TLS %v", tt.name, creds, tt.wantTLS)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// DebugHandler returns an http.Handler showing the state of the exporter as
+// plain text: the agent endpoint in use, connection and stream state, the
+// last error, what is buffered, what was dropped and the effective options.
+//
+// It can be mounted next to the zpages, e.g.
+//
+//	mux.Handle("/debug/hunter", exporter.DebugHandler())
+func (e *Exporter) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		e.writeDebug(w)
+	})
+}
+
+func (e *Exporter) writeDebug(out io.Writer) {
+	e.mu.Lock()
+	proto := e.proto
+	state := e.state
+	conn := "none"
+	if e.clientConn != nil {
+		conn = e.clientConn.GetState().String()
+	}
+	spanStream := e.exportClient != nil
+	metricsStream := e.metricsClient != nil
+	e.mu.Unlock()
+
+	e.debugMu.Lock()
+	lastErr, lastErrTime := e.lastErr, e.lastErrTime
+	dropped := make(map[string]int64, len(e.droppedSpans))
+	for reason, n := range e.droppedSpans {
+		dropped[reason] = n
+	}
+	droppedMetrics := e.droppedMetrics
+	truncated, split := e.truncatedSpans, e.splitBatches
+	e.debugMu.Unlock()
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Hunter agent exporter")
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "state:\t%s\n", state)
+	if proto != "" {
+		fmt.Fprintf(w, "endpoint:\t%s %s\n", proto, e.addrs[proto])
+	} else {
+		fmt.Fprintf(w, "endpoint:\tnone\n")
+	}
+	fmt.Fprintf(w, "connection:\t%s\n", conn)
+	fmt.Fprintf(w, "span stream:\t%s\n", openOrClosed(spanStream))
+	fmt.Fprintf(w, "metrics stream:\t%s\n", openOrClosed(metricsStream))
+	if lastErr != nil {
+		fmt.Fprintf(w, "last error:\t%s: %v\n", lastErrTime.Format(time.RFC3339), lastErr)
+	} else {
+		fmt.Fprintf(w, "last error:\tnone\n")
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "bundled spans:\t%d (%d bytes)\n", atomic.LoadInt64(&e.bundled), atomic.LoadInt64(&e.bundledBytes))
+	fmt.Fprintf(w, "uploading spans:\t%d\n", atomic.LoadInt64(&e.inflight))
+	fmt.Fprintf(w, "retry queue:\t%d spans (%d bytes)\n", e.queue.pendingSpans(), e.queue.pendingBytes())
+	if e.spool != nil {
+		fmt.Fprintf(w, "spool:\t%d bytes\n", e.spool.bytes())
+	}
+	fmt.Fprintf(w, "bundled metrics:\t%d\n", atomic.LoadInt64(&e.metricsBundled))
+	fmt.Fprintf(w, "uploading metrics:\t%d\n", atomic.LoadInt64(&e.metricsInflight))
+	fmt.Fprintln(w)
+
+	reasons := make([]string, 0, len(dropped))
+	for reason := range dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintf(w, "dropped spans:\t%d\n", sum(dropped))
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %s:\t%d\n", reason, dropped[reason])
+	}
+	fmt.Fprintf(w, "dropped metrics:\t%d\n", droppedMetrics)
+	fmt.Fprintf(w, "truncated spans:\t%d\n", truncated)
+	fmt.Fprintf(w, "split batches:\t%d\n", split)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "options:")
+	fmt.Fprintf(w, "  endpoints:\t%s\n", e.endpointList())
+	fmt.Fprintf(w, "  tls:\t%v\n", e.creds != nil)
+	fmt.Fprintf(w, "  non-blocking:\t%v\n", e.nonBlocking)
+	fmt.Fprintf(w, "  bundle delay:\t%v\n", e.bundler.DelayThreshold)
+	fmt.Fprintf(w, "  bundle count:\t%d\n", e.bundler.BundleCountThreshold)
+	fmt.Fprintf(w, "  bundle bytes:\t%d\n", e.bundler.BundleByteThreshold)
+	fmt.Fprintf(w, "  max message size:\t%d\n", e.maxMessageSize)
+	fmt.Fprintf(w, "  buffered byte limit:\t%d\n", e.bundler.BufferedByteLimit)
+	fmt.Fprintf(w, "  retry queue:\t%d bytes, %v\n", e.retryQueueBytes, e.retryQueueAge)
+	if e.spool != nil {
+		fmt.Fprintf(w, "  spool:\t%s, %d bytes\n", e.spoolDir, e.spoolBytes)
+	}
+	l := e.spanLimits
+	fmt.Fprintf(w, "  span limits:\t%d attributes, %d annotations, %d string bytes\n",
+		l.MaxAttributes, l.MaxAnnotations, l.MaxStringBytes)
+	p := e.retryPolicy
+	fmt.Fprintf(w, "  dial retry:\t%d attempts, %v elapsed, %v-%v backoff, %v timeout\n",
+		p.MaxAttempts, p.MaxElapsedTime, p.BaseDelay, p.MaxDelay, p.DialTimeout)
+	if len(e.endpoints) > 1 {
+		fmt.Fprintf(w, "  probe interval:\t%v\n", e.probeInterval)
+	}
+}
+
+// endpointList describes the configured transports, most preferred first.
+func (e *Exporter) endpointList() string {
+	list := make([]string, 0, len(e.endpoints))
+	for _, proto := range e.endpoints {
+		list = append(list, proto+" "+e.addrs[proto])
+	}
+	return strings.Join(list, ", ")
+}
+
+func openOrClosed(open bool) string {
+	if open {
+		return "open"
+	}
+	return "closed"
+}
+
+func sum(counts map[string]int64) int64 {
+	var n int64
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
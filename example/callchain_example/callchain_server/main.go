@@ -112,13 +112,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Start z-Pages server.
-	go func() {
-		mux := http.NewServeMux()
-		zpages.Handle(mux, "/debug")
-		log.Fatal(http.ListenAndServe("0.0.0.0:8081", mux))
-	}()
-
 	addrs := make(map[string]string, 2)
 	addrs["tcp"] = *agentIp + ":" + *agentPort
 	//addrs["unix"] = strings.TrimPrefix(*unixsockAddr, "unix://")
@@ -133,6 +126,14 @@ func main() {
 	}
 	defer exporter.Flush()
 
+	// Start z-Pages server, along with the exporter debug page.
+	go func() {
+		mux := http.NewServeMux()
+		zpages.Handle(mux, "/debug")
+		mux.Handle("/debug/hunter", exporter.DebugHandler())
+		log.Fatal(http.ListenAndServe("0.0.0.0:8081", mux))
+	}()
+
 	// Register stats and trace exporters to export
 	// the collected data.
 	view.RegisterExporter(exporter)
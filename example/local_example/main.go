@@ -67,6 +67,7 @@ func main() {
 
 	exporter, err := agent.NewExporter(
 		agent.Addrs(addrs),
+		agent.AnnotationKeys(map[string]string{"query": "query"}),
 		//agent.Logger(logger),
 	)
 	if err != nil {
@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/metricsproto"
+)
+
+const (
+	// exemplarsPerSeries is the number of recent samples kept for each
+	// measure and set of tag values to pick exemplars from.
+	exemplarsPerSeries = 64
+	// maxExemplarSeries bounds the number of measure and tag values
+	// combinations samples are kept for. The least recently recorded one is
+	// evicted to make room for a new one.
+	maxExemplarSeries = 512
+)
+
+// Attachment keys of the exemplars, holding hex encoded IDs.
+const (
+	ExemplarTraceIDKey = "trace_id"
+	ExemplarSpanIDKey  = "span_id"
+)
+
+// exemplarSample is a measurement recorded within a span.
+type exemplarSample struct {
+	value   float64
+	time    time.Time
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+// exemplarSeries keeps the most recent samples of a measure recorded with
+// the same tag values, in a ring.
+type exemplarSeries struct {
+	measure string
+	key     string // see tagsKey
+	tags    *tag.Map
+	samples []exemplarSample
+	next    int
+	elem    *list.Element // in exemplarStore.order
+}
+
+// exemplarStore keeps the samples by measure and tag values, so that the
+// samples of a busy series do not push those of the others out.
+type exemplarStore struct {
+	mu     sync.Mutex
+	series map[string]map[string]*exemplarSeries // by measure, then tagsKey
+	order  *list.List                            // of *exemplarSeries, least recently recorded first
+}
+
+var exemplars = newExemplarStore()
+
+func newExemplarStore() *exemplarStore {
+	return &exemplarStore{
+		series: make(map[string]map[string]*exemplarSeries),
+		order:  list.New(),
+	}
+}
+
+// RecordWithExemplar records measurements like stats.Record, and remembers
+// them along with the span in ctx, if any. Distribution views exported to
+// Hunter then carry these samples as exemplars, linking histogram buckets to
+// the traces that fell into them.
+//
+// Only measurements recorded through RecordWithExemplar are remembered: the
+// ocgrpc and ochttp plugins record through stats.Record, so the histograms
+// of their views carry no exemplars.
+func RecordWithExemplar(ctx context.Context, ms ...stats.Measurement) {
+	stats.Record(ctx, ms...)
+
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	sc := span.SpanContext()
+	tags := tag.FromContext(ctx)
+	key := tagsKey(tags)
+	now := time.Now()
+
+	for _, m := range ms {
+		if m.Measure() == nil {
+			continue
+		}
+		exemplars.add(m.Measure().Name(), key, tags, exemplarSample{
+			value:   m.Value(),
+			time:    now,
+			traceID: sc.TraceID,
+			spanID:  sc.SpanID,
+		})
+	}
+}
+
+// tagsKey returns a string identifying the tag values of m.
+func tagsKey(m *tag.Map) string {
+	if m == nil {
+		return ""
+	}
+	var pairs []string
+	tag.DecodeEach(tag.Encode(m), func(k tag.Key, v string) {
+		pairs = append(pairs, strconv.Quote(k.Name())+"="+strconv.Quote(v))
+	})
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s *exemplarStore) add(measure, key string, tags *tag.Map, sample exemplarSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byTags := s.series[measure]
+	if byTags == nil {
+		byTags = make(map[string]*exemplarSeries)
+		s.series[measure] = byTags
+	}
+	ser := byTags[key]
+	if ser == nil {
+		if s.order.Len() >= maxExemplarSeries {
+			s.evict(s.order.Front().Value.(*exemplarSeries))
+		}
+		ser = &exemplarSeries{measure: measure, key: key, tags: tags}
+		ser.elem = s.order.PushBack(ser)
+		byTags[key] = ser
+	} else {
+		s.order.MoveToBack(ser.elem)
+	}
+
+	if len(ser.samples) < exemplarsPerSeries {
+		ser.samples = append(ser.samples, sample)
+		return
+	}
+	ser.samples[ser.next] = sample
+	ser.next = (ser.next + 1) % exemplarsPerSeries
+}
+
+// evict forgets ser. s.mu must be held.
+func (s *exemplarStore) evict(ser *exemplarSeries) {
+	s.order.Remove(ser.elem)
+	byTags := s.series[ser.measure]
+	delete(byTags, ser.key)
+	if len(byTags) == 0 {
+		delete(s.series, ser.measure)
+	}
+}
+
+// pick returns at most one exemplar per bucket of the distribution row of
+// vd: the most recent sample recorded by then with the same tag values as
+// row. vd.Start is not checked, the worker sets it on the first report,
+// after the first samples were recorded.
+func (s *exemplarStore) pick(vd *view.Data, row *view.Row) []*metricsproto.DistributionValue_Exemplar {
+	v := vd.View
+	bounds := v.Aggregation.Buckets
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest := make(map[int]exemplarSample)
+	for _, ser := range s.series[v.Measure.Name()] {
+		// The view may aggregate several series into row.
+		if !sameTags(v.TagKeys, ser.tags, row.Tags) {
+			continue
+		}
+		for _, sample := range ser.samples {
+			if sample.time.After(vd.End) {
+				continue
+			}
+			b := bucketIndex(bounds, sample.value)
+			if cur, ok := latest[b]; !ok || sample.time.After(cur.time) {
+				latest[b] = sample
+			}
+		}
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+
+	// Report them in bucket order.
+	var ex []*metricsproto.DistributionValue_Exemplar
+	for b := 0; b <= len(bounds); b++ {
+		sample, ok := latest[b]
+		if !ok {
+			continue
+		}
+		ex = append(ex, &metricsproto.DistributionValue_Exemplar{
+			Value:     sample.value,
+			Timestamp: timestampProto(sample.time),
+			Attachments: map[string]string{
+				ExemplarTraceIDKey: hex.EncodeToString(sample.traceID[:]),
+				ExemplarSpanIDKey:  hex.EncodeToString(sample.spanID[:]),
+			},
+		})
+	}
+	return ex
+}
+
+// sameTags reports whether the sample tags m hold the row tags for each of
+// the view's keys.
+func sameTags(keys []tag.Key, m *tag.Map, tags []tag.Tag) bool {
+	for _, k := range keys {
+		want, wantOK := "", false
+		for _, t := range tags {
+			if t.Key == k {
+				want, wantOK = t.Value, true
+				break
+			}
+		}
+
+		var got string
+		var gotOK bool
+		if m != nil {
+			got, gotOK = m.Value(k)
+		}
+		if got != want || gotOK != wantOK {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketIndex returns the bucket of the distribution that v falls into, the
+// same way view.Distribution counts it.
+func bucketIndex(bounds []float64, v float64) int {
+	for i, b := range bounds {
+		if v < b {
+			return i
+		}
+	}
+	return len(bounds)
+}
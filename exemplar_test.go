@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestExemplarsBySeries(t *testing.T) {
+	method, _ := tag.NewKey("exemplar_test_method")
+	m := stats.Float64("exemplar_test/latency", "", stats.UnitMilliseconds)
+	v := &view.View{
+		Measure:     m,
+		TagKeys:     []tag.Key{method},
+		Aggregation: view.Distribution(10, 100),
+	}
+	s := newExemplarStore()
+	now := time.Now()
+
+	record := func(value string, span uint64, latency float64) {
+		ctx, _ := tag.New(context.Background(), tag.Insert(method, value))
+		tags := tag.FromContext(ctx)
+		s.add(m.Name(), tagsKey(tags), tags, exemplarSample{
+			value:  latency,
+			time:   now,
+			spanID: spanID(span),
+		})
+	}
+	// A single sample for "slow", then enough for "fast" to fill a ring.
+	record("slow", 1, 500)
+	for i := 0; i < 2*exemplarsPerSeries; i++ {
+		record("fast", 2, 5)
+	}
+
+	vd := &view.Data{View: v, End: now}
+	for _, tt := range []struct {
+		method string
+		want   []float64
+	}{
+		{"slow", []float64{500}},
+		{"fast", []float64{5}},
+		{"other", nil},
+	} {
+		row := &view.Row{Tags: []tag.Tag{{Key: method, Value: tt.method}}}
+		var got []float64
+		for _, ex := range s.pick(vd, row) {
+			got = append(got, ex.Value)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s: exemplars %v, want %v", tt.method, got, tt.want)
+		}
+	}
+
+	// A view without the key aggregates both series in one row.
+	all := &view.Data{View: &view.View{Measure: m, Aggregation: v.Aggregation}, End: now}
+	if got := len(s.pick(all, &view.Row{})); got != 2 {
+		t.Errorf("%d exemplars for the row of all series, want 2", got)
+	}
+}
+
+func TestExemplarSeriesEviction(t *testing.T) {
+	s := newExemplarStore()
+	sample := exemplarSample{value: 1, time: time.Now()}
+	for i := 0; i < maxExemplarSeries; i++ {
+		s.add("m", string(rune('a'+i)), nil, sample)
+	}
+	// Recording for the first series again makes the second the least
+	// recently recorded one, evicted to make room.
+	s.add("m", "a", nil, sample)
+	s.add("other", "", nil, sample)
+
+	if _, ok := s.series["m"]["a"]; !ok {
+		t.Error("series a evicted, want kept")
+	}
+	if _, ok := s.series["m"]["b"]; ok {
+		t.Error("series b kept, want evicted")
+	}
+	if got := s.order.Len(); got != maxExemplarSeries {
+		t.Errorf("%d series, want %d", got, maxExemplarSeries)
+	}
+}
+
+func TestTagsKey(t *testing.T) {
+	k1, _ := tag.NewKey("exemplar_test_k1")
+	k2, _ := tag.NewKey("exemplar_test_k2")
+	ctx1, _ := tag.New(context.Background(), tag.Insert(k1, "a"), tag.Insert(k2, "b"))
+	ctx2, _ := tag.New(context.Background(), tag.Insert(k2, "b"), tag.Insert(k1, "a"))
+	ctx3, _ := tag.New(context.Background(), tag.Insert(k1, "a,b"))
+
+	if tagsKey(tag.FromContext(ctx1)) != tagsKey(tag.FromContext(ctx2)) {
+		t.Error("same tags, inserted in another order, have different keys")
+	}
+	if tagsKey(tag.FromContext(ctx1)) == tagsKey(tag.FromContext(ctx3)) {
+		t.Error("different tags have the same key")
+	}
+	if tagsKey(nil) != "" {
+		t.Errorf("tagsKey(nil) = %q, want empty", tagsKey(nil))
+	}
+}
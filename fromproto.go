@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"go.opencensus.io/trace"
+)
+
+// FromProtoSpan converts a span, as sent to Hunter agent, back to a
+// trace.SpanData, e.g. to replay captured spans into another exporter.
+//
+// What the agent representation does not hold is lost: values truncated by
+// SpanLimits stay truncated, dropped attributes and events stay dropped, and
+// floats are strings. Spans are assumed to be sampled, as only those are
+// exported.
+func FromProtoSpan(sp *traceproto.Span) (*trace.SpanData, error) {
+	if sp == nil {
+		return nil, nil
+	}
+
+	s := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceOptions: trace.TraceOptions(1),
+		},
+		SpanKind:  fromProtoSpanKind(sp.Kind),
+		Name:      sp.GetName().GetValue(),
+		StartTime: fromTimestampProto(sp.StartTime),
+		EndTime:   fromTimestampProto(sp.EndTime),
+	}
+	if err := copyID(s.TraceID[:], sp.TraceId, "trace"); err != nil {
+		return nil, err
+	}
+	if err := copyID(s.SpanID[:], sp.SpanId, "span"); err != nil {
+		return nil, err
+	}
+	if len(sp.ParentSpanId) > 0 {
+		if err := copyID(s.ParentSpanID[:], sp.ParentSpanId, "parent span"); err != nil {
+			return nil, err
+		}
+		s.HasRemoteParent = sp.SameProcessAsParentSpan != nil && !sp.SameProcessAsParentSpan.Value
+	}
+	if sp.Status != nil {
+		s.Code = sp.Status.Code
+		s.Message = sp.Status.Message
+	}
+
+	s.Attributes = fromProtoAttributes(sp.Attributes)
+	for _, te := range sp.GetTimeEvents().GetTimeEvent() {
+		switch v := te.Value.(type) {
+		case *traceproto.Span_TimeEvent_Annotation_:
+			s.Annotations = append(s.Annotations, trace.Annotation{
+				Time:       fromTimestampProto(te.Time),
+				Message:    v.Annotation.GetDescription().GetValue(),
+				Attributes: fromProtoAttributes(v.Annotation.Attributes),
+			})
+		case *traceproto.Span_TimeEvent_MessageEvent_:
+			s.MessageEvents = append(s.MessageEvents, trace.MessageEvent{
+				Time:                 fromTimestampProto(te.Time),
+				EventType:            fromProtoMessageEventType(v.MessageEvent.Type),
+				MessageID:            int64(v.MessageEvent.Id),
+				UncompressedByteSize: int64(v.MessageEvent.UncompressedSize),
+				CompressedByteSize:   int64(v.MessageEvent.CompressedSize),
+			})
+		}
+	}
+	for _, l := range sp.GetLinks().GetLink() {
+		link := trace.Link{
+			Type:       fromProtoLinkType(l.Type),
+			Attributes: fromProtoAttributes(l.Attributes),
+		}
+		if err := copyID(link.TraceID[:], l.TraceId, "link trace"); err != nil {
+			return nil, err
+		}
+		if err := copyID(link.SpanID[:], l.SpanId, "link span"); err != nil {
+			return nil, err
+		}
+		s.Links = append(s.Links, link)
+	}
+
+	return s, nil
+}
+
+// copyID copies the ID src to dst, checking it has the right length.
+func copyID(dst, src []byte, what string) error {
+	if len(src) != len(dst) {
+		return fmt.Errorf("invalid %s ID length %d, want %d", what, len(src), len(dst))
+	}
+	copy(dst, src)
+	return nil
+}
+
+func fromProtoAttributes(attrs *traceproto.Span_Attributes) map[string]interface{} {
+	if len(attrs.GetAttributeMap()) == 0 {
+		return nil
+	}
+
+	m := make(map[string]interface{}, len(attrs.AttributeMap))
+	for k, v := range attrs.AttributeMap {
+		switch v := v.GetValue().(type) {
+		case *traceproto.AttributeValue_StringValue:
+			m[k] = v.StringValue.GetValue()
+		case *traceproto.AttributeValue_IntValue:
+			m[k] = v.IntValue
+		case *traceproto.AttributeValue_BoolValue:
+			m[k] = v.BoolValue
+		}
+	}
+	return m
+}
+
+// fromTimestampProto converts ts to a UTC time, or the zero time if ts is
+// nil.
+func fromTimestampProto(ts *timestamp.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()
+}
+
+func fromProtoSpanKind(k traceproto.Span_SpanKind) int {
+	switch k {
+	case traceproto.Span_SERVER:
+		return trace.SpanKindServer
+	case traceproto.Span_CLIENT:
+		return trace.SpanKindClient
+	}
+	return trace.SpanKindUnspecified
+}
+
+func fromProtoMessageEventType(t traceproto.Span_TimeEvent_MessageEvent_Type) trace.MessageEventType {
+	switch t {
+	case traceproto.Span_TimeEvent_MessageEvent_SENT:
+		return trace.MessageEventTypeSent
+	case traceproto.Span_TimeEvent_MessageEvent_RECEIVED:
+		return trace.MessageEventTypeRecv
+	}
+	return trace.MessageEventTypeUnspecified
+}
+
+func fromProtoLinkType(t traceproto.Span_Link_Type) trace.LinkType {
+	switch t {
+	case traceproto.Span_Link_CHILD_LINKED_SPAN:
+		return trace.LinkTypeChild
+	case traceproto.Span_Link_PARENT_LINKED_SPAN:
+		return trace.LinkTypeParent
+	}
+	return trace.LinkTypeUnspecified
+}
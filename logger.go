@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// LevelLogger is a leveled, structured logger. Messages come with fields as
+// alternating keys and values, e.g.
+//
+//	l.Warn("cannot connect to agent", "addr", addr, "err", err)
+//
+// Implement it to plug the exporter into your own logging pipeline, or use
+// StdLogger and NopLogger.
+type LevelLogger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level is the severity of a log message.
+type Level int
+
+// Levels, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// StdLogger returns a LevelLogger writing to l the messages of level min and
+// above, one line per message with the level, the message and the fields as
+// key=value pairs.
+func StdLogger(l *log.Logger, min Level) LevelLogger {
+	return stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+func (s stdLogger) Debug(msg string, keyvals ...interface{}) { s.output(LevelDebug, msg, keyvals) }
+func (s stdLogger) Info(msg string, keyvals ...interface{})  { s.output(LevelInfo, msg, keyvals) }
+func (s stdLogger) Warn(msg string, keyvals ...interface{})  { s.output(LevelWarn, msg, keyvals) }
+func (s stdLogger) Error(msg string, keyvals ...interface{}) { s.output(LevelError, msg, keyvals) }
+
+func (s stdLogger) output(level Level, msg string, keyvals []interface{}) {
+	if level < s.min {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], v)
+	}
+	s.l.Output(3, b.String())
+}
+
+// NopLogger returns a LevelLogger discarding everything.
+func NopLogger() LevelLogger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+var (
+	pkgLoggerMu sync.Mutex
+	pkgLogger   = StdLogger(log.New(os.Stderr, "[hunter-agent-exporter] ", log.LstdFlags), LevelInfo)
+)
+
+// SetLogger sets the logger used by the package outside of an exporter, e.g.
+// by ConfigRead. Exporters log through the Logger or LeveledLogger option.
+func SetLogger(l LevelLogger) {
+	pkgLoggerMu.Lock()
+	defer pkgLoggerMu.Unlock()
+	pkgLogger = l
+}
+
+func packageLogger() LevelLogger {
+	pkgLoggerMu.Lock()
+	defer pkgLoggerMu.Unlock()
+	return pkgLogger
+}
@@ -0,0 +1,22 @@
+package agent
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0), LevelInfo)
+
+	l.Debug("hidden", "k", 1)
+	l.Info("shown", "k", 2)
+	l.Warn("odd", "k")
+	l.Error("failed", "err", "boom")
+
+	want := "INFO shown k=2\nWARN odd k=MISSING\nERROR failed err=boom\n"
+	if got := buf.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/metricsproto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// DroppedMetricsError is reported through the ErrFun hook when metrics are
+// permanently lost.
+type DroppedMetricsError struct {
+	// Count is the number of metrics dropped.
+	Count int
+	// Reason tells why they were dropped.
+	Reason string
+}
+
+func (e *DroppedMetricsError) Error() string {
+	return fmt.Sprintf("dropped %d metrics: %s", e.Count, e.Reason)
+}
+
+// uploadMetrics sends a set of metrics on the ExportMetrics stream. Unlike
+// spans, metrics are not retried: views are exported again at the next
+// reporting period anyway.
+func (e *Exporter) uploadMetrics(metrics []*metricsproto.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	atomic.AddInt64(&e.metricsInflight, int64(len(metrics)))
+	defer atomic.AddInt64(&e.metricsInflight, -int64(len(metrics)))
+
+	e.metricsMu.Lock()
+	defer e.metricsMu.Unlock()
+
+	stream, err := e.metricsStream()
+	if err == nil {
+		err = stream.Send(&exporterproto.ExportMetricsRequest{Metrics: metrics})
+		if err != nil {
+			e.resetMetricsStream(stream)
+		}
+	}
+	if err != nil {
+		if err != errNoConnection {
+			e.onError(err)
+		}
+		e.dropMetrics(len(metrics), "cannot send metrics to agent")
+	}
+}
+
+// metricsStream returns the ExportMetrics stream of the current connection,
+// opening it first if needed. e.metricsMu must be held.
+func (e *Exporter) metricsStream() (exporterproto.Export_ExportMetricsClient, error) {
+	e.mu.Lock()
+	cc := e.clientConn
+	stream := e.metricsClient
+	e.mu.Unlock()
+
+	if stream != nil {
+		return stream, nil
+	}
+	if cc == nil {
+		return nil, errNoConnection
+	}
+
+	stream, err := exporterproto.NewExportClient(cc).ExportMetrics(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.clientConn != cc {
+		// The connection has been replaced in the meantime, which
+		// cancelled the stream as well.
+		return nil, errNoConnection
+	}
+	done := make(chan struct{})
+	e.metricsClient = stream
+	e.metricsDone = done
+	go e.watchMetricsStream(stream, done)
+
+	return stream, nil
+}
+
+// watchMetricsStream drains the receiving side of stream and forgets it once
+// it breaks, so that the next upload opens a new one. done is closed then.
+func (e *Exporter) watchMetricsStream(stream exporterproto.Export_ExportMetricsClient, done chan struct{}) {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			close(done)
+			e.resetMetricsStream(stream)
+			return
+		}
+	}
+}
+
+// resetMetricsStream forgets the broken stream, if it is still the current
+// one. The connection itself is left alone: the span stream watches it.
+func (e *Exporter) resetMetricsStream(broken exporterproto.Export_ExportMetricsClient) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.metricsClient == broken {
+		e.metricsClient = nil
+		e.metricsDone = nil
+	}
+}
+
+// dropMetrics reports n metrics as permanently lost.
+func (e *Exporter) dropMetrics(n int, reason string) {
+	if n > 0 {
+		e.debugMu.Lock()
+		e.droppedMetrics += int64(n)
+		e.debugMu.Unlock()
+
+		e.onError(&DroppedMetricsError{Count: n, Reason: reason})
+	}
+}
+
+// toProtoMetric converts the data collected for a view into a metric.
+func toProtoMetric(vd *view.Data) *metricsproto.Metric {
+	if vd == nil || vd.View == nil {
+		return nil
+	}
+
+	v := vd.View
+	desc := &metricsproto.MetricDescriptor{
+		Name:        v.Name,
+		Description: v.Description,
+		Unit:        v.Measure.Unit(),
+		Type:        metricType(v),
+		LabelKeys:   make([]*metricsproto.LabelKey, 0, len(v.TagKeys)),
+	}
+	if v.Aggregation.Type == view.AggTypeCount {
+		desc.Unit = stats.UnitDimensionless
+	}
+	for _, k := range v.TagKeys {
+		desc.LabelKeys = append(desc.LabelKeys, &metricsproto.LabelKey{Key: k.Name()})
+	}
+
+	m := &metricsproto.Metric{MetricDescriptor: desc}
+
+	end := timestampProto(vd.End)
+	switch desc.Type {
+	case metricsproto.MetricDescriptor_GAUGE_INT64, metricsproto.MetricDescriptor_GAUGE_DOUBLE:
+		m.GaugeTimeseries = make([]*metricsproto.GaugeTimeSeries, 0, len(vd.Rows))
+		for _, row := range vd.Rows {
+			m.GaugeTimeseries = append(m.GaugeTimeseries, &metricsproto.GaugeTimeSeries{
+				LabelValues: labelValues(v, row),
+				Points:      []*metricsproto.Point{toProtoPoint(vd, desc.Type, row, end)},
+			})
+		}
+	default:
+		start := timestampProto(vd.Start)
+		m.CumulativeTimeseries = make([]*metricsproto.CumulativeTimeSeries, 0, len(vd.Rows))
+		for _, row := range vd.Rows {
+			m.CumulativeTimeseries = append(m.CumulativeTimeseries, &metricsproto.CumulativeTimeSeries{
+				StartTime:   start,
+				LabelValues: labelValues(v, row),
+				Points:      []*metricsproto.Point{toProtoPoint(vd, desc.Type, row, end)},
+			})
+		}
+	}
+
+	return m
+}
+
+// metricType tells which kind of metric the view produces. Sums and last
+// values of an Int64Measure stay integers.
+func metricType(v *view.View) metricsproto.MetricDescriptor_Type {
+	_, isInt := v.Measure.(*stats.Int64Measure)
+
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		return metricsproto.MetricDescriptor_CUMULATIVE_INT64
+	case view.AggTypeSum:
+		if isInt {
+			return metricsproto.MetricDescriptor_CUMULATIVE_INT64
+		}
+		return metricsproto.MetricDescriptor_CUMULATIVE_DOUBLE
+	case view.AggTypeDistribution:
+		return metricsproto.MetricDescriptor_CUMULATIVE_DISTRIBUTION
+	case view.AggTypeLastValue:
+		if isInt {
+			return metricsproto.MetricDescriptor_GAUGE_INT64
+		}
+		return metricsproto.MetricDescriptor_GAUGE_DOUBLE
+	}
+	return metricsproto.MetricDescriptor_UNSPECIFIED
+}
+
+// labelValues returns the values of row's tags, in the order of the view's
+// tag keys. Keys the row has no tag for are marked as missing.
+func labelValues(v *view.View, row *view.Row) []*metricsproto.LabelValue {
+	values := make([]*metricsproto.LabelValue, 0, len(v.TagKeys))
+	for _, k := range v.TagKeys {
+		lv := &metricsproto.LabelValue{}
+		for _, t := range row.Tags {
+			if t.Key == k {
+				lv.Value = t.Value
+				lv.HasValue = true
+				break
+			}
+		}
+		values = append(values, lv)
+	}
+	return values
+}
+
+func toProtoPoint(vd *view.Data, typ metricsproto.MetricDescriptor_Type, row *view.Row, ts *timestamp.Timestamp) *metricsproto.Point {
+	p := &metricsproto.Point{Timestamp: ts}
+
+	switch d := row.Data.(type) {
+	case *view.CountData:
+		p.Value = &metricsproto.Point_Int64Value{Int64Value: d.Value}
+	case *view.SumData:
+		setNumber(p, typ, d.Value)
+	case *view.LastValueData:
+		setNumber(p, typ, d.Value)
+	case *view.DistributionData:
+		p.Value = &metricsproto.Point_DistributionValue{
+			DistributionValue: toProtoDistribution(vd, row, d),
+		}
+	}
+	return p
+}
+
+// toProtoDistribution converts the distribution row of vd, along with the
+// exemplars recorded for it, see RecordWithExemplar.
+func toProtoDistribution(vd *view.Data, row *view.Row, d *view.DistributionData) *metricsproto.DistributionValue {
+	dv := &metricsproto.DistributionValue{
+		Count:                 d.Count,
+		Mean:                  d.Mean,
+		SumOfSquaredDeviation: d.SumOfSquaredDev,
+	}
+
+	// Without bounds there is no histogram, nor exemplars.
+	bounds := vd.View.Aggregation.Buckets
+	if len(bounds) == 0 {
+		return dv
+	}
+
+	dv.BucketBounds = bounds
+	dv.Buckets = make([]*metricsproto.DistributionValue_Bucket, 0, len(d.CountPerBucket))
+	for _, n := range d.CountPerBucket {
+		dv.Buckets = append(dv.Buckets, &metricsproto.DistributionValue_Bucket{Count: n})
+	}
+	dv.Exemplars = exemplars.pick(vd, row)
+	return dv
+}
+
+// setNumber sets v as the value of p, as an integer for the integer metric
+// types.
+func setNumber(p *metricsproto.Point, typ metricsproto.MetricDescriptor_Type, v float64) {
+	switch typ {
+	case metricsproto.MetricDescriptor_CUMULATIVE_INT64, metricsproto.MetricDescriptor_GAUGE_INT64:
+		p.Value = &metricsproto.Point_Int64Value{Int64Value: int64(v)}
+	default:
+		p.Value = &metricsproto.Point_DoubleValue{DoubleValue: v}
+	}
+}
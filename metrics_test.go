@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/metricsproto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestToProtoMetric(t *testing.T) {
+	method, _ := tag.NewKey("metrics_test_method")
+	status, _ := tag.NewKey("metrics_test_status")
+	intMeasure := stats.Int64("metrics_test/bytes", "", stats.UnitBytes)
+	floatMeasure := stats.Float64("metrics_test/latency", "", stats.UnitMilliseconds)
+
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute + 500*time.Millisecond)
+	startTS := &timestamp.Timestamp{Seconds: start.Unix()}
+	endTS := &timestamp.Timestamp{Seconds: end.Unix(), Nanos: 5e8}
+
+	intValue := func(v int64) *metricsproto.Point {
+		return &metricsproto.Point{Timestamp: endTS, Value: &metricsproto.Point_Int64Value{Int64Value: v}}
+	}
+	doubleValue := func(v float64) *metricsproto.Point {
+		return &metricsproto.Point{Timestamp: endTS, Value: &metricsproto.Point_DoubleValue{DoubleValue: v}}
+	}
+
+	tests := []struct {
+		name        string
+		measure     stats.Measure
+		aggregation *view.Aggregation
+		// data holds the data of the two rows.
+		data     [2]view.AggregationData
+		wantType metricsproto.MetricDescriptor_Type
+		wantUnit string
+		want     [2]*metricsproto.Point
+	}{
+		{
+			name:        "count",
+			measure:     floatMeasure,
+			aggregation: view.Count(),
+			data:        [2]view.AggregationData{&view.CountData{Value: 3}, &view.CountData{Value: 1}},
+			wantType:    metricsproto.MetricDescriptor_CUMULATIVE_INT64,
+			wantUnit:    stats.UnitDimensionless,
+			want:        [2]*metricsproto.Point{intValue(3), intValue(1)},
+		},
+		{
+			name:        "int sum",
+			measure:     intMeasure,
+			aggregation: view.Sum(),
+			data:        [2]view.AggregationData{&view.SumData{Value: 1024}, &view.SumData{Value: 2}},
+			wantType:    metricsproto.MetricDescriptor_CUMULATIVE_INT64,
+			wantUnit:    stats.UnitBytes,
+			want:        [2]*metricsproto.Point{intValue(1024), intValue(2)},
+		},
+		{
+			name:        "float sum",
+			measure:     floatMeasure,
+			aggregation: view.Sum(),
+			data:        [2]view.AggregationData{&view.SumData{Value: 1.5}, &view.SumData{Value: 2}},
+			wantType:    metricsproto.MetricDescriptor_CUMULATIVE_DOUBLE,
+			wantUnit:    stats.UnitMilliseconds,
+			want:        [2]*metricsproto.Point{doubleValue(1.5), doubleValue(2)},
+		},
+		{
+			name:        "int last value",
+			measure:     intMeasure,
+			aggregation: view.LastValue(),
+			data:        [2]view.AggregationData{&view.LastValueData{Value: 7}, &view.LastValueData{Value: 8}},
+			wantType:    metricsproto.MetricDescriptor_GAUGE_INT64,
+			wantUnit:    stats.UnitBytes,
+			want:        [2]*metricsproto.Point{intValue(7), intValue(8)},
+		},
+		{
+			name:        "float last value",
+			measure:     floatMeasure,
+			aggregation: view.LastValue(),
+			data:        [2]view.AggregationData{&view.LastValueData{Value: 0.25}, &view.LastValueData{Value: 8}},
+			wantType:    metricsproto.MetricDescriptor_GAUGE_DOUBLE,
+			wantUnit:    stats.UnitMilliseconds,
+			want:        [2]*metricsproto.Point{doubleValue(0.25), doubleValue(8)},
+		},
+		{
+			name:        "distribution",
+			measure:     intMeasure,
+			aggregation: view.Distribution(10, 100),
+			data: [2]view.AggregationData{
+				&view.DistributionData{Count: 3, Mean: 40, SumOfSquaredDev: 5000, CountPerBucket: []int64{1, 1, 1}},
+				&view.DistributionData{Count: 1, Mean: 5, CountPerBucket: []int64{1, 0, 0}},
+			},
+			wantType: metricsproto.MetricDescriptor_CUMULATIVE_DISTRIBUTION,
+			wantUnit: stats.UnitBytes,
+			want: [2]*metricsproto.Point{
+				{Timestamp: endTS, Value: &metricsproto.Point_DistributionValue{DistributionValue: &metricsproto.DistributionValue{
+					Count: 3, Mean: 40, SumOfSquaredDeviation: 5000,
+					BucketBounds: []float64{10, 100},
+					Buckets:      []*metricsproto.DistributionValue_Bucket{{Count: 1}, {Count: 1}, {Count: 1}},
+				}}},
+				{Timestamp: endTS, Value: &metricsproto.Point_DistributionValue{DistributionValue: &metricsproto.DistributionValue{
+					Count: 1, Mean: 5,
+					BucketBounds: []float64{10, 100},
+					Buckets:      []*metricsproto.DistributionValue_Bucket{{Count: 1}, {Count: 0}, {Count: 0}},
+				}}},
+			},
+		},
+	}
+
+	// The first row has its tags in another order than the view's keys,
+	// the second has no status tag.
+	labels := [2][]*metricsproto.LabelValue{
+		{{Value: "GET", HasValue: true}, {Value: "200", HasValue: true}},
+		{{Value: "POST", HasValue: true}, {}},
+	}
+	for _, tt := range tests {
+		vd := &view.Data{
+			View: &view.View{
+				Name:        "metrics_test/" + tt.name,
+				Description: tt.name,
+				TagKeys:     []tag.Key{method, status},
+				Measure:     tt.measure,
+				Aggregation: tt.aggregation,
+			},
+			Start: start,
+			End:   end,
+			Rows: []*view.Row{
+				{Tags: []tag.Tag{{Key: status, Value: "200"}, {Key: method, Value: "GET"}}, Data: tt.data[0]},
+				{Tags: []tag.Tag{{Key: method, Value: "POST"}}, Data: tt.data[1]},
+			},
+		}
+
+		want := &metricsproto.Metric{
+			MetricDescriptor: &metricsproto.MetricDescriptor{
+				Name:        vd.View.Name,
+				Description: tt.name,
+				Unit:        tt.wantUnit,
+				Type:        tt.wantType,
+				LabelKeys:   []*metricsproto.LabelKey{{Key: method.Name()}, {Key: status.Name()}},
+			},
+		}
+		for i, p := range tt.want {
+			switch tt.wantType {
+			case metricsproto.MetricDescriptor_GAUGE_INT64, metricsproto.MetricDescriptor_GAUGE_DOUBLE:
+				want.GaugeTimeseries = append(want.GaugeTimeseries, &metricsproto.GaugeTimeSeries{
+					LabelValues: labels[i],
+					Points:      []*metricsproto.Point{p},
+				})
+			default:
+				want.CumulativeTimeseries = append(want.CumulativeTimeseries, &metricsproto.CumulativeTimeSeries{
+					StartTime:   startTS,
+					LabelValues: labels[i],
+					Points:      []*metricsproto.Point{p},
+				})
+			}
+		}
+
+		if got := toProtoMetric(vd); !proto.Equal(got, want) {
+			t.Errorf("%s: toProtoMetric() =\n%v\nwant\n%v", tt.name, proto.MarshalTextString(got), proto.MarshalTextString(want))
+		}
+	}
+}
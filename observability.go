@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// The following measures are recorded by the exporter about itself. They
+// are only collected once views over them are registered, see DefaultViews.
+var (
+	SpansReceived     = stats.Int64("hunter/exporter/spans_received", "Number of spans handed to the exporter.", stats.UnitDimensionless)
+	SpansSent         = stats.Int64("hunter/exporter/spans_sent", "Number of spans sent to the agent.", stats.UnitDimensionless)
+	SpansDropped      = stats.Int64("hunter/exporter/spans_dropped", "Number of spans permanently lost.", stats.UnitDimensionless)
+	AttributesDropped = stats.Int64("hunter/exporter/attributes_dropped", "Number of span attributes left out because of their value type.", stats.UnitDimensionless)
+	BatchSize         = stats.Int64("hunter/exporter/batch_size", "Number of spans per batch uploaded to the agent.", stats.UnitDimensionless)
+	SendLatency       = stats.Float64("hunter/exporter/send_latency", "Time taken to write a batch to the agent stream.", stats.UnitMilliseconds)
+	Reconnects        = stats.Int64("hunter/exporter/reconnects", "Number of times the connection to the agent was lost.", stats.UnitDimensionless)
+	SpansTruncated    = stats.Int64("hunter/exporter/spans_truncated", "Number of spans truncated to fit in a request.", stats.UnitDimensionless)
+	BatchesSplit      = stats.Int64("hunter/exporter/batches_split", "Number of batches split in several requests.", stats.UnitDimensionless)
+)
+
+// KeyReason tells why spans were dropped. Its values are the reasons of the
+// DroppedSpansError reported through the ErrFun hook, plus "overflow" when
+// the exporter buffer is full.
+var KeyReason, _ = tag.NewKey("reason")
+
+const reasonOverflow = "overflow"
+
+// Predefined views over the above measures. None are registered by default.
+var (
+	SpansReceivedView = &view.View{
+		Measure:     SpansReceived,
+		Name:        "hunter/exporter/spans_received",
+		Description: "Count of spans handed to the exporter.",
+		Aggregation: view.Sum(),
+	}
+
+	SpansSentView = &view.View{
+		Measure:     SpansSent,
+		Name:        "hunter/exporter/spans_sent",
+		Description: "Count of spans sent to the agent.",
+		Aggregation: view.Sum(),
+	}
+
+	SpansDroppedView = &view.View{
+		Measure:     SpansDropped,
+		Name:        "hunter/exporter/spans_dropped",
+		Description: "Count of spans permanently lost, by reason.",
+		TagKeys:     []tag.Key{KeyReason},
+		Aggregation: view.Sum(),
+	}
+
+	AttributesDroppedView = &view.View{
+		Measure:     AttributesDropped,
+		Name:        "hunter/exporter/attributes_dropped",
+		Description: "Count of span attributes of an unknown value type.",
+		Aggregation: view.Sum(),
+	}
+
+	BatchSizeView = &view.View{
+		Measure:     BatchSize,
+		Name:        "hunter/exporter/batch_size",
+		Description: "Distribution of the number of spans per batch.",
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000),
+	}
+
+	SendLatencyView = &view.View{
+		Measure:     SendLatency,
+		Name:        "hunter/exporter/send_latency",
+		Description: "Distribution of the time taken to send a batch.",
+		Aggregation: view.Distribution(0, 0.1, 0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 5000),
+	}
+
+	ReconnectsView = &view.View{
+		Measure:     Reconnects,
+		Name:        "hunter/exporter/reconnects",
+		Description: "Count of lost connections to the agent.",
+		Aggregation: view.Count(),
+	}
+
+	SpansTruncatedView = &view.View{
+		Measure:     SpansTruncated,
+		Name:        "hunter/exporter/spans_truncated",
+		Description: "Count of spans truncated to fit in a request.",
+		Aggregation: view.Sum(),
+	}
+
+	BatchesSplitView = &view.View{
+		Measure:     BatchesSplit,
+		Name:        "hunter/exporter/batches_split",
+		Description: "Count of batches split in several requests.",
+		Aggregation: view.Sum(),
+	}
+)
+
+// DefaultViews are the views to register to monitor the exporter, e.g. to
+// alert on trace loss.
+var DefaultViews = []*view.View{
+	SpansReceivedView,
+	SpansSentView,
+	SpansDroppedView,
+	AttributesDroppedView,
+	BatchSizeView,
+	SendLatencyView,
+	ReconnectsView,
+	SpansTruncatedView,
+	BatchesSplitView,
+}
+
+// recordDropped records n spans dropped for reason.
+func recordDropped(n int, reason string) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(KeyReason, reason))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, SpansDropped.M(int64(n)))
+}
+
+// recordSend records a Send of n spans that started at start, and whether
+// it succeeded.
+func recordSend(n int, start time.Time, ok bool) {
+	latency := SendLatency.M(float64(time.Since(start)) / float64(time.Millisecond))
+	if !ok {
+		stats.Record(context.Background(), latency)
+		return
+	}
+	stats.Record(context.Background(), latency, SpansSent.M(int64(n)))
+}
@@ -18,11 +18,15 @@ const (
 
 var DefaultTCPEndpoint = fmt.Sprintf("%s:%d", DefaultTCPHost, DefaultTCPPort)
 
+// DefaultMaxMessageSize is the default receive limit of gRPC servers, hence
+// of Hunter agent.
+const DefaultMaxMessageSize = 4 * 1024 * 1024
+
 // options are the options to be used when initializing the Hunter agent exporter.
 type options struct {
 	// Hunter agent listening address
 	addrs  map[string]string
-	logger *log.Logger
+	logger LevelLogger
 
 	// OnError is the hook to be called when there is
 	// an error occurred.
@@ -38,6 +42,84 @@ type options struct {
 	// can be buffered before batch uploading them to the backend.
 	// Optional.
 	bundleCountThreshold int
+	// bundleByteThreshold determines the encoded size of the spans
+	// buffered before batch uploading them to the backend.
+	// Optional.
+	bundleByteThreshold int
+	// bufferedByteLimit caps the encoded size of the spans waiting to be
+	// batched, beyond which new spans are dropped.
+	// Optional.
+	bufferedByteLimit int
+	// maxMessageSize is the largest request the agent accepts.
+	// Optional.
+	maxMessageSize int
+
+	// retryQueueBytes caps the total encoded size of the span batches kept
+	// in memory for resending after a failed upload. Zero disables retries.
+	// Optional.
+	retryQueueBytes int
+	// retryQueueAge is how long a failed batch is kept for resending
+	// before it is dropped. Zero means no age limit.
+	// Optional.
+	retryQueueAge time.Duration
+
+	// spoolDir is the directory of the on-disk spool where span batches
+	// that cannot be kept in memory are written until the agent is back.
+	// Empty disables the spool.
+	// Optional.
+	spoolDir string
+	// spoolBytes caps the total size of the spool files.
+	spoolBytes int64
+
+	// tlsServerCA, tlsClientCert and tlsClientKey are PEM files used to
+	// secure the tcp endpoint. Setting any of them enables TLS, the unix
+	// socket always stays plaintext.
+	// Optional.
+	tlsServerCA   string
+	tlsClientCert string
+	tlsClientKey  string
+	// tlsServerName overrides the server name checked against the agent
+	// certificate, which defaults to the host of the tcp address.
+	// Optional.
+	tlsServerName string
+
+	// retryPolicy controls dialing retries, when connecting as well as
+	// when reconnecting.
+	// Optional.
+	retryPolicy RetryPolicy
+
+	// nonBlocking makes NewExporter return without waiting for the
+	// connection to the agent, which is then dialed in the background.
+	// Optional.
+	nonBlocking bool
+
+	// probeInterval is how often the exporter, while connected through a
+	// fallback transport, checks whether the preferred one is available
+	// again.
+	// Optional.
+	probeInterval time.Duration
+
+	// onStateChange is called on each transition of the exporter State.
+	// Optional.
+	onStateChange func(old, new State)
+
+	// captureStacksOnError makes the exporter capture the stack of the
+	// goroutine ending a span with a non-OK status.
+	// Optional.
+	captureStacksOnError bool
+
+	// spanLimits bounds what is exported of each span.
+	// Optional.
+	spanLimits SpanLimits
+
+	// unknownAttributes tells what to do with attribute values of an
+	// unsupported type.
+	// Optional.
+	unknownAttributes AttributePolicy
+
+	// annotationKeys maps annotation attribute keys to span attributes.
+	// Optional.
+	annotationKeys map[string]string
 }
 
 var defaultExporterOptions = options{
@@ -45,16 +127,109 @@ var defaultExporterOptions = options{
 		"tcp": DefaultTCPEndpoint,
 		//"unix": DefaultUnixSocketEndpoint,
 	},
-	logger:               log.New(os.Stderr, "[hunter-agent-exporter] ", log.LstdFlags),
+	logger:               StdLogger(log.New(os.Stderr, "[hunter-agent-exporter] ", log.LstdFlags), LevelInfo),
 	onError:              nil,
 	bundleDelayThreshold: 2 * time.Second,
 	bundleCountThreshold: 300,
+	retryQueueBytes:      8 * 1024 * 1024,
+	retryQueueAge:        time.Minute,
+	probeInterval:        30 * time.Second,
+	retryPolicy:          DefaultRetryPolicy,
+	spanLimits:           DefaultSpanLimits,
+	maxMessageSize:       DefaultMaxMessageSize,
+}
+
+// SpanLimits bounds what is exported of each span. What is cut is reported
+// to the agent in the dropped and truncated counts of the span. Zero means
+// no limit.
+type SpanLimits struct {
+	// MaxAttributes is the number of attributes kept per span, as well as
+	// per annotation and per link.
+	MaxAttributes int
+	// MaxAnnotations is the number of annotations kept per span, the most
+	// recent ones.
+	MaxAnnotations int
+	// MaxStringBytes is the size kept of the span name, of its status
+	// message and of string attribute values. Strings are cut on a UTF-8
+	// character boundary. The status message has no truncated count.
+	MaxStringBytes int
+}
+
+// DefaultSpanLimits are the SpanLimits used unless Limits is given.
+var DefaultSpanLimits = SpanLimits{
+	MaxAttributes:  128,
+	MaxAnnotations: 128,
+	MaxStringBytes: 8 * 1024,
+}
+
+// Jitter selects how randomness is applied to the backoff delays of a
+// RetryPolicy.
+type Jitter int
+
+const (
+	// MicrosecondJitter adds up to 100 microseconds to each delay.
+	MicrosecondJitter Jitter = iota
+	// FullJitter waits a random period between zero and the delay.
+	FullJitter
+	// EqualJitter waits half the delay plus a random period up to the other
+	// half.
+	EqualJitter
+)
+
+// RetryPolicy controls how the exporter retries dialing the Hunter agent.
+//
+// NewExporter gives up once MaxAttempts or MaxElapsedTime is reached. When
+// reconnecting, the exporter reports the failure through the ErrFun hook
+// instead and starts over after MaxDelay, until it is stopped.
+type RetryPolicy struct {
+	// MaxAttempts is the number of dial attempts before giving up, each of
+	// them trying every configured transport. Zero means no limit.
+	MaxAttempts int
+	// MaxElapsedTime bounds the time spent retrying. Zero means no limit.
+	MaxElapsedTime time.Duration
+	// BaseDelay is the delay after the first failed attempt, it doubles
+	// after each subsequent one.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. Zero means no cap.
+	MaxDelay time.Duration
+	// Jitter selects how the delays are randomized.
+	Jitter Jitter
+	// DialTimeout bounds each dial attempt.
+	DialTimeout time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used unless DialRetry is given.
+// In the worst case of (no agent actually available), connecting takes about
+// 5 * 3s per configured transport, plus (1+2+4+8) * 0.05s of backoff.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Jitter:      MicrosecondJitter,
+	DialTimeout: 3 * time.Second,
 }
 
 // ExporterOption sets options such as addrs, logger, etc.
 type ExporterOption func(*options)
 
-// Logger sets the logger used to report errors.
+// newOptions returns the default options with opt applied.
+func newOptions(opt ...ExporterOption) options {
+	o := defaultExporterOptions
+	// The options must not write to the map of the defaults, shared by all
+	// exporters.
+	o.addrs = make(map[string]string, len(defaultExporterOptions.addrs))
+	for proto, addr := range defaultExporterOptions.addrs {
+		o.addrs[proto] = addr
+	}
+	for _, f := range opt {
+		f(&o)
+	}
+	return o
+}
+
+// Addrs sets the addresses of Hunter agent, by transport ("unix" or "tcp"),
+// on top of the default tcp address. The unix socket is preferred, with
+// fallback to tcp. Use OnlyAddrs to leave the default out.
 func Addrs(addrs map[string]string) ExporterOption {
 	return func(o *options) {
 		for k, v := range addrs {
@@ -63,8 +238,32 @@ func Addrs(addrs map[string]string) ExporterOption {
 	}
 }
 
-// Logger sets the logger used to report errors.
+// OnlyAddrs sets the addresses of Hunter agent, by transport ("unix" or
+// "tcp"), replacing the default tcp address: e.g. only the unix socket is
+// used, without fallback, with
+//
+//	agent.OnlyAddrs(map[string]string{"unix": agent.DefaultUnixSocketEndpoint})
+func OnlyAddrs(addrs map[string]string) ExporterOption {
+	return func(o *options) {
+		o.addrs = make(map[string]string, len(addrs))
+		for k, v := range addrs {
+			o.addrs[k] = v
+		}
+	}
+}
+
+// Logger sets the logger used to report errors and connection events,
+// messages of level Info and above. Use LeveledLogger with StdLogger to
+// choose the level.
 func Logger(logger *log.Logger) ExporterOption {
+	return func(o *options) {
+		o.logger = StdLogger(logger, LevelInfo)
+	}
+}
+
+// LeveledLogger sets the logger used to report errors and connection
+// events. Use NopLogger to silence the exporter.
+func LeveledLogger(logger LevelLogger) ExporterOption {
 	return func(o *options) {
 		o.logger = logger
 	}
@@ -90,3 +289,182 @@ func CountThreshold(cnt int) ExporterOption {
 		o.bundleCountThreshold = cnt
 	}
 }
+
+// ByteThreshold sets the encoded size of the spans that can be buffered
+// before batch uploading them to the backend, which also caps the size of a
+// batch. The default is 1 MiB.
+func ByteThreshold(n int) ExporterOption {
+	return func(o *options) {
+		o.bundleByteThreshold = n
+	}
+}
+
+// BufferedByteLimit sets the total encoded size of the spans waiting to be
+// batched, beyond which new spans are dropped. Spans larger than
+// ByteThreshold, uploaded on their own, count against it until they are
+// uploaded. The default is 64 MiB.
+func BufferedByteLimit(n int) ExporterOption {
+	return func(o *options) {
+		o.bufferedByteLimit = n
+	}
+}
+
+// MaxMessageSize sets the size of the largest request the agent accepts, as
+// configured on its gRPC server. Batches of spans larger than that are split
+// into several requests, and spans that do not fit in a request on their own
+// are truncated or, failing that, dropped. The default is
+// DefaultMaxMessageSize.
+func MaxMessageSize(n int) ExporterOption {
+	return func(o *options) {
+		o.maxMessageSize = n
+	}
+}
+
+// RetryQueue sets the total encoded size and the maximum age of the span
+// batches kept in memory for resending after a failed upload. A maxBytes of
+// zero disables resending, failed batches are then dropped right away.
+func RetryQueue(maxBytes int, maxAge time.Duration) ExporterOption {
+	return func(o *options) {
+		o.retryQueueBytes = maxBytes
+		o.retryQueueAge = maxAge
+	}
+}
+
+// Spool enables the on-disk spool: span batches that cannot be sent nor kept
+// in the retry queue are written to segment files in dir, using at most
+// maxBytes, and replayed once the agent is reachable again, including after
+// the process restarts.
+func Spool(dir string, maxBytes int64) ExporterOption {
+	return func(o *options) {
+		o.spoolDir = dir
+		o.spoolBytes = maxBytes
+	}
+}
+
+// ServerCA sets the PEM file of the CA certificates used to verify the agent
+// when connecting to its tcp address over TLS.
+func ServerCA(caFile string) ExporterOption {
+	return func(o *options) {
+		o.tlsServerCA = caFile
+	}
+}
+
+// ClientCert sets the PEM files of the certificate and key presented to the
+// agent for mutual TLS on its tcp address.
+func ClientCert(certFile, keyFile string) ExporterOption {
+	return func(o *options) {
+		o.tlsClientCert = certFile
+		o.tlsClientKey = keyFile
+	}
+}
+
+// ServerNameOverride sets the name expected in the agent certificate instead
+// of the host of its tcp address.
+func ServerNameOverride(name string) ExporterOption {
+	return func(o *options) {
+		o.tlsServerName = name
+	}
+}
+
+// ProbeInterval sets how often the exporter, while connected through the tcp
+// address because the unix socket was unavailable, tries to switch back to
+// the unix socket. Zero disables switching back.
+func ProbeInterval(t time.Duration) ExporterOption {
+	return func(o *options) {
+		o.probeInterval = t
+	}
+}
+
+// NonBlocking makes NewExporter return right away instead of waiting for the
+// agent to be reachable: the connection is established in the background and
+// spans exported meanwhile are kept in the retry queue, see RetryQueue. Use
+// Exporter.WaitReady to wait for the connection.
+func NonBlocking() ExporterOption {
+	return func(o *options) {
+		o.nonBlocking = true
+	}
+}
+
+// DialRetry sets the policy used to retry dialing the agent, both when
+// connecting and when reconnecting. Zero BaseDelay and DialTimeout are taken
+// from DefaultRetryPolicy.
+func DialRetry(p RetryPolicy) ExporterOption {
+	return func(o *options) {
+		if p.BaseDelay <= 0 {
+			p.BaseDelay = DefaultRetryPolicy.BaseDelay
+		}
+		if p.DialTimeout <= 0 {
+			p.DialTimeout = DefaultRetryPolicy.DialTimeout
+		}
+		o.retryPolicy = p
+	}
+}
+
+// OnStateChange sets a hook called on each transition of the exporter State,
+// e.g. to report agent outages. Transitions are delivered in order from a
+// dedicated goroutine, the last one being to Shutdown.
+func OnStateChange(fn func(old, new State)) ExporterOption {
+	return func(o *options) {
+		o.onStateChange = fn
+	}
+}
+
+// CaptureStacksOnError makes the exporter attach the stack trace of the
+// goroutine that ends a span to the span, when its status is not OK. Use
+// CaptureStack to attach a stack to any span.
+func CaptureStacksOnError() ExporterOption {
+	return func(o *options) {
+		o.captureStacksOnError = true
+	}
+}
+
+// AttributePolicy tells what the exporter does with the attributes of spans,
+// annotations and links whose value has an unsupported type, i.e. none of
+// string, bool, integer and floating point types.
+type AttributePolicy int
+
+const (
+	// DropUnknownAttributes drops them, they are counted in the dropped
+	// attributes count of the span and by the AttributesDropped measure.
+	DropUnknownAttributes AttributePolicy = iota
+	// StringifyUnknownAttributes sends them as strings, formatted with
+	// fmt.Sprint.
+	StringifyUnknownAttributes
+	// ReportUnknownAttributes drops them like DropUnknownAttributes, and
+	// reports each of them as an *AttributeTypeError through the ErrFun
+	// hook.
+	ReportUnknownAttributes
+)
+
+// UnknownAttributes sets what to do with attribute values of an unsupported
+// type. The default is DropUnknownAttributes.
+func UnknownAttributes(p AttributePolicy) ExporterOption {
+	return func(o *options) {
+		o.unknownAttributes = p
+	}
+}
+
+// AnnotationKeys copies the annotation attributes with the given keys to
+// span attributes, which Hunter agent indexes, e.g.
+//
+//	agent.AnnotationKeys(map[string]string{"query": "db.statement"})
+//
+// exports the "query" attribute of annotations as the "db.statement"
+// attribute of their span. An attribute set on the span itself is left
+// untouched, and the most recent annotation wins over earlier ones. The
+// annotations keep their attributes.
+func AnnotationKeys(keys map[string]string) ExporterOption {
+	return func(o *options) {
+		o.annotationKeys = make(map[string]string, len(keys))
+		for k, name := range keys {
+			o.annotationKeys[k] = name
+		}
+	}
+}
+
+// Limits sets the limits enforced on each exported span, see SpanLimits.
+func Limits(l SpanLimits) ExporterOption {
+	return func(o *options) {
+		o.spanLimits = l
+	}
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEndpointOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  []ExporterOption
+		want []string
+	}{
+		{"default", nil, []string{"tcp"}},
+		{"unix with tcp fallback", []ExporterOption{Addrs(map[string]string{"unix": "/x.sock"})}, []string{"unix", "tcp"}},
+		{"unix only", []ExporterOption{OnlyAddrs(map[string]string{"unix": "/x.sock"})}, []string{"unix"}},
+		{"tcp only", []ExporterOption{OnlyAddrs(map[string]string{"tcp": "127.0.0.1:1"})}, []string{"tcp"}},
+	}
+	for _, tt := range tests {
+		o := newOptions(tt.opt...)
+		got, err := endpointOrder(&o)
+		if err != nil {
+			t.Errorf("%s: endpointOrder: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: endpointOrder = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOptionsDoNotLeak(t *testing.T) {
+	newOptions(Addrs(map[string]string{"unix": "/x.sock", "tcp": "10.0.0.1:1"}))
+
+	o := newOptions()
+	if len(o.addrs) != 1 || o.addrs["tcp"] != DefaultTCPEndpoint {
+		t.Errorf("addrs after another exporter set its own = %v, want only the default tcp endpoint", o.addrs)
+	}
+}
+
+func TestOnlyAddrsEmpty(t *testing.T) {
+	o := newOptions(OnlyAddrs(nil))
+	if _, err := endpointOrder(&o); err == nil {
+		t.Error("endpointOrder without addresses: got no error")
+	}
+}
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opencensus.io/trace"
+)
+
+// spanBuf holds a converted span along with the objects it points to, so
+// that converting a span allocates nothing once the buffer has grown to fit.
+// It is what the exporter bundles.
+//
+// Buffers come from spanBufPool and go back to it once the span has been
+// written to a stream. A span queued for retry or spooled keeps its buffer,
+// which is then left to the garbage collector.
+type spanBuf struct {
+	span traceproto.Span
+	// size is the encoded size of span.
+	size int
+
+	traceID    trace.TraceID
+	spanID     trace.SpanID
+	name       traceproto.TruncatableString
+	start, end timestamp.Timestamp
+	status     traceproto.Status
+	attrs      traceproto.Span_Attributes
+	timeEvents traceproto.Span_TimeEvents
+	sameProc   wrappers.BoolValue
+	children   wrappers.UInt32Value
+	parentID   [8]byte
+
+	// Slabs the attribute values, time events and attribute maps of the span
+	// are carved from.
+	values    []attrValue
+	events    []timeEvent
+	eventPtrs []*traceproto.Span_TimeEvent
+	maps      []map[string]*traceproto.AttributeValue
+	nValues   int
+	nEvents   int
+	nPtrs     int
+	nMaps     int
+}
+
+// attrValue is an attribute value, with room for each of its kinds.
+type attrValue struct {
+	v   traceproto.AttributeValue
+	s   traceproto.AttributeValue_StringValue
+	i   traceproto.AttributeValue_IntValue
+	b   traceproto.AttributeValue_BoolValue
+	str traceproto.TruncatableString
+}
+
+// timeEvent is a time event, with room for each of its kinds.
+type timeEvent struct {
+	te    traceproto.Span_TimeEvent
+	time  timestamp.Timestamp
+	ann   traceproto.Span_TimeEvent_Annotation_
+	a     traceproto.Span_TimeEvent_Annotation
+	desc  traceproto.TruncatableString
+	attrs traceproto.Span_Attributes
+	msg   traceproto.Span_TimeEvent_MessageEvent_
+	m     traceproto.Span_TimeEvent_MessageEvent
+}
+
+var spanBufPool = sync.Pool{
+	New: func() interface{} { return new(spanBuf) },
+}
+
+func getSpanBuf() *spanBuf {
+	return spanBufPool.Get().(*spanBuf)
+}
+
+// putSpanBuf resets b and returns it to the pool. Nothing may point to its
+// span anymore.
+func putSpanBuf(b *spanBuf) {
+	b.reset()
+	spanBufPool.Put(b)
+}
+
+// reset forgets the span held in b, keeping the slabs for the next one.
+func (b *spanBuf) reset() {
+	b.span = traceproto.Span{}
+	b.size = 0
+	for i := range b.values[:b.nValues] {
+		b.values[i] = attrValue{}
+	}
+	for i := range b.events[:b.nEvents] {
+		b.events[i] = timeEvent{}
+	}
+	for i := range b.eventPtrs[:b.nPtrs] {
+		b.eventPtrs[i] = nil
+	}
+	for _, m := range b.maps[:b.nMaps] {
+		for k := range m {
+			delete(m, k)
+		}
+	}
+	b.nValues, b.nEvents, b.nPtrs, b.nMaps = 0, 0, 0, 0
+}
+
+// value returns an unused attribute value. When the slab is exhausted, a
+// larger one replaces it: the values handed out so far keep pointing into the
+// previous one.
+func (b *spanBuf) value() *attrValue {
+	if b.nValues == len(b.values) {
+		b.values = make([]attrValue, growSlab(len(b.values)))
+		b.nValues = 0
+	}
+	b.nValues++
+	return &b.values[b.nValues-1]
+}
+
+// event returns an unused time event, see value.
+func (b *spanBuf) event() *timeEvent {
+	if b.nEvents == len(b.events) {
+		b.events = make([]timeEvent, growSlab(len(b.events)))
+		b.nEvents = 0
+	}
+	b.nEvents++
+	return &b.events[b.nEvents-1]
+}
+
+// eventSlice returns an empty slice of time events with capacity n.
+func (b *spanBuf) eventSlice(n int) []*traceproto.Span_TimeEvent {
+	if n == 0 {
+		return nil
+	}
+	if b.nPtrs+n > len(b.eventPtrs) {
+		size := growSlab(len(b.eventPtrs))
+		if size < n {
+			size = n
+		}
+		b.eventPtrs = make([]*traceproto.Span_TimeEvent, size)
+		b.nPtrs = 0
+	}
+	s := b.eventPtrs[b.nPtrs : b.nPtrs : b.nPtrs+n]
+	b.nPtrs += n
+	return s
+}
+
+// attributeMap returns an empty attribute map.
+func (b *spanBuf) attributeMap(n int) map[string]*traceproto.AttributeValue {
+	if b.nMaps == len(b.maps) {
+		b.maps = append(b.maps, make(map[string]*traceproto.AttributeValue, n))
+	}
+	b.nMaps++
+	return b.maps[b.nMaps-1]
+}
+
+// growSlab returns the size of the slab replacing an exhausted one of size n.
+func growSlab(n int) int {
+	if n < 16 {
+		return 16
+	}
+	return 2 * n
+}
+
+var requestPool = sync.Pool{
+	New: func() interface{} { return new(exporterproto.ExportSpanRequest) },
+}
+
+// getRequest returns an empty request with room for n spans.
+func getRequest(n int) *exporterproto.ExportSpanRequest {
+	req := requestPool.Get().(*exporterproto.ExportSpanRequest)
+	if cap(req.Spans) < n {
+		req.Spans = make([]*traceproto.Span, 0, n)
+	}
+	return req
+}
+
+// putRequest returns req to the pool. Nothing may point to it anymore.
+func putRequest(req *exporterproto.ExportSpanRequest) {
+	for i := range req.Spans {
+		req.Spans[i] = nil
+	}
+	*req = exporterproto.ExportSpanRequest{Spans: req.Spans[:0]}
+	requestPool.Put(req)
+}
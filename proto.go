@@ -1,124 +1,381 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/trace"
 )
 
-func toProtoSpan(s *trace.SpanData) *traceproto.Span {
+// converter converts spans to their protobuf representation, enforcing the
+// configured SpanLimits.
+type converter struct {
+	limits  SpanLimits
+	unknown AttributePolicy
+	// annotationKeys maps annotation attribute keys to the span attributes
+	// they are copied to.
+	annotationKeys map[string]string
+	logger         LevelLogger
+	onError        func(error)
+}
+
+// AttributeTypeError is reported through the ErrFun hook for attributes of
+// an unsupported value type, under the ReportUnknownAttributes policy.
+type AttributeTypeError struct {
+	Key   string
+	Value interface{}
+}
+
+func (e *AttributeTypeError) Error() string {
+	return fmt.Sprintf("attribute %q has unsupported value type %T, dropped", e.Key, e.Value)
+}
+
+// toProtoSpan converts s into b, or a new buffer if b is nil, and returns the
+// converted span.
+func (c *converter) toProtoSpan(b *spanBuf, s *trace.SpanData) *traceproto.Span {
 	if s == nil {
 		return nil
 	}
+	if b == nil {
+		b = new(spanBuf)
+	}
 
-	sp := &traceproto.Span{
-		TraceId: s.SpanContext.TraceID[:],
-		SpanId:  s.SpanContext.SpanID[:],
-		Name: &traceproto.TruncatableString{
-			Value: s.Name,
-		},
-		Kind: spanKind(s),
-		StartTime: &timestamp.Timestamp{
-			Seconds: s.StartTime.Unix(),
-			Nanos:   int32(s.StartTime.Nanosecond()),
-		},
-		EndTime: &timestamp.Timestamp{
-			Seconds: s.EndTime.Unix(),
-			Nanos:   int32(s.EndTime.Nanosecond()),
-		},
-		Attributes: convertToAttributes(s.Attributes),
-		//StackTrace: &traceproto.StackTrace{},
-		TimeEvents: convertToTimeEvents(s.Annotations, s.MessageEvents),
-		//Links:      &traceproto.Span_Links{},
-		Status: &traceproto.Status{
-			Code:    s.Code,
-			Message: s.Message,
-		},
+	c.truncate(&b.name, s.Name)
+	setTimestamp(&b.start, s.StartTime)
+	setTimestamp(&b.end, s.EndTime)
+	b.status = traceproto.Status{
+		Code:    s.Code,
+		Message: c.cut(s.Message),
+	}
+	b.traceID = s.TraceID
+	b.spanID = s.SpanID
+	b.span = traceproto.Span{
+		TraceId:    b.traceID[:],
+		SpanId:     b.spanID[:],
+		Name:       &b.name,
+		Kind:       spanKind(s),
+		StartTime:  &b.start,
+		EndTime:    &b.end,
+		Attributes: c.convertToAttributes(b, &b.attrs, c.spanAttributes(s)),
+		TimeEvents: c.convertToTimeEvents(b, s.Annotations, s.MessageEvents),
+		Links:      c.convertToLinks(b, s.Links),
+		Status:     &b.status,
 	}
 
 	if s.ParentSpanID != (trace.SpanID{}) {
-		sp.ParentSpanId = make([]byte, 8)
-		copy(sp.ParentSpanId, s.ParentSpanID[:])
+		b.parentID = s.ParentSpanID
+		b.span.ParentSpanId = b.parentID[:]
+		b.sameProc = wrappers.BoolValue{Value: !s.HasRemoteParent}
+		b.span.SameProcessAsParentSpan = &b.sameProc
 	}
 
-	return sp
+	return &b.span
 }
 
-func convertToAttributes(tags map[string]interface{}) *traceproto.Span_Attributes {
-	attributes := &traceproto.Span_Attributes{
-		AttributeMap: make(map[string]*traceproto.AttributeValue),
+// spanAttributes returns the attributes of s, along with those copied from
+// its annotations according to annotationKeys. Attributes set on the span
+// itself take precedence, then the most recent annotation does.
+func (c *converter) spanAttributes(s *trace.SpanData) map[string]interface{} {
+	if len(c.annotationKeys) == 0 || len(s.Annotations) == 0 {
+		return s.Attributes
 	}
 
-	for k, i := range tags {
-		switch v := i.(type) {
-		case string:
-			attributes.AttributeMap[k] = &traceproto.AttributeValue{
-				Value: &traceproto.AttributeValue_StringValue{
-					StringValue: &traceproto.TruncatableString{
-						Value: v,
-					},
-				},
+	var tags map[string]interface{}
+	for i := len(s.Annotations) - 1; i >= 0; i-- {
+		for k, v := range s.Annotations[i].Attributes {
+			name, ok := c.annotationKeys[k]
+			if !ok {
+				continue
+			}
+			if _, ok := s.Attributes[name]; ok {
+				continue
 			}
-		case bool:
-			attributes.AttributeMap[k] = &traceproto.AttributeValue{
-				Value: &traceproto.AttributeValue_BoolValue{
-					BoolValue: v,
-				},
+			if tags == nil {
+				tags = make(map[string]interface{}, len(s.Attributes)+len(c.annotationKeys))
+				for k, v := range s.Attributes {
+					tags[k] = v
+				}
 			}
-		case int64:
-			attributes.AttributeMap[k] = &traceproto.AttributeValue{
-				Value: &traceproto.AttributeValue_IntValue{
-					IntValue: int64(v),
-				},
+			if _, ok := tags[name]; !ok {
+				tags[name] = v
 			}
-		default:
-			fmt.Printf("unknown tag value type:%v, ignored\n", v)
 		}
 	}
-
-	return attributes
+	if tags == nil {
+		return s.Attributes
+	}
+	return tags
 }
 
-func convertToTimeEvents(as []trace.Annotation, ms []trace.MessageEvent) *traceproto.Span_TimeEvents {
-	timeEvents := &traceproto.Span_TimeEvents{
-		TimeEvent: make([]*traceproto.Span_TimeEvent, 0, 10),
+// convertToAttributes converts tags into dst, with values and map from b.
+func (c *converter) convertToAttributes(b *spanBuf, dst *traceproto.Span_Attributes, tags map[string]interface{}) *traceproto.Span_Attributes {
+	*dst = traceproto.Span_Attributes{
+		AttributeMap: b.attributeMap(len(tags)),
 	}
-	for _, a := range as {
-		timeEvents.TimeEvent = append(timeEvents.TimeEvent,
-			&traceproto.Span_TimeEvent{
-				Time:  &timestamp.Timestamp{Seconds: a.Time.Unix(), Nanos: int32(a.Time.UnixNano())},
-				Value: convertAnnoationToTimeEvent(a.Attributes),
-			},
-		)
+
+	// Beyond MaxAttributes, the first keys in lexical order are kept, so
+	// that the same attributes are dropped from similar spans.
+	if max := c.limits.MaxAttributes; max > 0 && len(tags) > max {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dst.DroppedAttributesCount = int32(len(tags) - max)
+		for _, k := range keys[:max] {
+			c.addAttribute(b, dst, k, tags[k])
+		}
+		return dst
 	}
-	for _, m := range ms {
-		timeEvents.TimeEvent = append(timeEvents.TimeEvent,
-			&traceproto.Span_TimeEvent{
-				Time:  &timestamp.Timestamp{Seconds: m.Time.Unix(), Nanos: int32(m.Time.UnixNano())},
-				Value: convertMessageEventToTimeEvent(&m),
-			},
-		)
+
+	for k, v := range tags {
+		c.addAttribute(b, dst, k, v)
 	}
-	return timeEvents
+	return dst
 }
 
-func convertAnnoationToTimeEvent(annotations map[string]interface{}) *traceproto.Span_TimeEvent_Annotation_ {
-	teAnnotation := &traceproto.Span_TimeEvent_Annotation_{
-		Annotation: &traceproto.Span_TimeEvent_Annotation{
-			Description: &traceproto.TruncatableString{
-				Value: "user supplied log",
-			},
-			Attributes: convertToAttributes(annotations),
-		},
+func (c *converter) addAttribute(b *spanBuf, dst *traceproto.Span_Attributes, k string, v interface{}) {
+	if av := c.attributeValue(b, k, v); av != nil {
+		dst.AttributeMap[k] = av
+	} else {
+		dst.DroppedAttributesCount++
 	}
-	return teAnnotation
 }
-func convertMessageEventToTimeEvent(m *trace.MessageEvent) *traceproto.Span_TimeEvent_MessageEvent_ {
+
+// attributeValue converts the value of the attribute k, or returns nil if it
+// is dropped.
+//
+// The agent only knows about strings, integers and booleans: other integer
+// types are widened to int64, unless they overflow it, and floats are sent
+// as the shortest string parsing back to the same value. Any other type is
+// handled according to the AttributePolicy.
+func (c *converter) attributeValue(b *spanBuf, k string, i interface{}) *traceproto.AttributeValue {
+	switch v := i.(type) {
+	case string:
+		return c.stringValue(b, v)
+	case bool:
+		av := b.value()
+		av.b.BoolValue = v
+		av.v.Value = &av.b
+		return &av.v
+	case int64:
+		return intValue(b, v)
+	case int:
+		return intValue(b, int64(v))
+	case int32:
+		return intValue(b, int64(v))
+	case int16:
+		return intValue(b, int64(v))
+	case int8:
+		return intValue(b, int64(v))
+	case uint32:
+		return intValue(b, int64(v))
+	case uint16:
+		return intValue(b, int64(v))
+	case uint8:
+		return intValue(b, int64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			return c.stringValue(b, strconv.FormatUint(v, 10))
+		}
+		return intValue(b, int64(v))
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return c.stringValue(b, strconv.FormatUint(uint64(v), 10))
+		}
+		return intValue(b, int64(v))
+	case float64:
+		return c.stringValue(b, strconv.FormatFloat(v, 'g', -1, 64))
+	case float32:
+		return c.stringValue(b, strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+
+	switch c.unknown {
+	case StringifyUnknownAttributes:
+		return c.stringValue(b, fmt.Sprint(i))
+	case ReportUnknownAttributes:
+		c.onError(&AttributeTypeError{Key: k, Value: i})
+	default:
+		c.logger.Debug("unsupported attribute value type, dropped", "key", k, "type", fmt.Sprintf("%T", i))
+	}
+	stats.Record(context.Background(), AttributesDropped.M(1))
 	return nil
 }
 
+func (c *converter) stringValue(b *spanBuf, s string) *traceproto.AttributeValue {
+	av := b.value()
+	c.truncate(&av.str, s)
+	av.s.StringValue = &av.str
+	av.v.Value = &av.s
+	return &av.v
+}
+
+func intValue(b *spanBuf, i int64) *traceproto.AttributeValue {
+	av := b.value()
+	av.i.IntValue = i
+	av.v.Value = &av.i
+	return &av.v
+}
+
+// truncate sets dst to s, cut to at most MaxStringBytes.
+func (c *converter) truncate(dst *traceproto.TruncatableString, s string) {
+	v := c.cut(s)
+	*dst = traceproto.TruncatableString{
+		Value:              v,
+		TruncatedByteCount: int32(len(s) - len(v)),
+	}
+}
+
+// cut returns s cut to at most MaxStringBytes without splitting a UTF-8
+// encoded character.
+func (c *converter) cut(s string) string {
+	max := c.limits.MaxStringBytes
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (c *converter) convertToTimeEvents(b *spanBuf, as []trace.Annotation, ms []trace.MessageEvent) *traceproto.Span_TimeEvents {
+	// Beyond MaxAnnotations, the most recent annotations are kept.
+	var dropped int
+	if max := c.limits.MaxAnnotations; max > 0 && len(as) > max {
+		dropped = len(as) - max
+		as = as[dropped:]
+	}
+
+	b.timeEvents = traceproto.Span_TimeEvents{
+		TimeEvent:               b.eventSlice(len(as) + len(ms)),
+		DroppedAnnotationsCount: int32(dropped),
+	}
+	for i := range as {
+		ev := b.event()
+		setTimestamp(&ev.time, as[i].Time)
+		c.truncate(&ev.desc, as[i].Message)
+		ev.a.Description = &ev.desc
+		ev.a.Attributes = c.convertToAttributes(b, &ev.attrs, as[i].Attributes)
+		ev.ann.Annotation = &ev.a
+		ev.te.Time = &ev.time
+		ev.te.Value = &ev.ann
+		b.timeEvents.TimeEvent = append(b.timeEvents.TimeEvent, &ev.te)
+	}
+	for i := range ms {
+		if !validMessageEvent(&ms[i]) {
+			b.timeEvents.DroppedMessageEventsCount++
+			continue
+		}
+		ev := b.event()
+		setTimestamp(&ev.time, ms[i].Time)
+		setMessageEvent(&ev.m, &ms[i])
+		ev.msg.MessageEvent = &ev.m
+		ev.te.Time = &ev.time
+		ev.te.Value = &ev.msg
+		b.timeEvents.TimeEvent = append(b.timeEvents.TimeEvent, &ev.te)
+	}
+	return &b.timeEvents
+}
+
+// validMessageEvent reports whether m can be represented: its type is known,
+// and its ID and sizes are not negative.
+func validMessageEvent(m *trace.MessageEvent) bool {
+	switch m.EventType {
+	case trace.MessageEventTypeSent, trace.MessageEventTypeRecv, trace.MessageEventTypeUnspecified:
+	default:
+		return false
+	}
+	return m.MessageID >= 0 && m.UncompressedByteSize >= 0 && m.CompressedByteSize >= 0
+}
+
+// setMessageEvent sets dst to m, which must be valid.
+func setMessageEvent(dst *traceproto.Span_TimeEvent_MessageEvent, m *trace.MessageEvent) {
+	typ := traceproto.Span_TimeEvent_MessageEvent_TYPE_UNSPECIFIED
+	switch m.EventType {
+	case trace.MessageEventTypeSent:
+		typ = traceproto.Span_TimeEvent_MessageEvent_SENT
+	case trace.MessageEventTypeRecv:
+		typ = traceproto.Span_TimeEvent_MessageEvent_RECEIVED
+	}
+	*dst = traceproto.Span_TimeEvent_MessageEvent{
+		Type:             typ,
+		Id:               uint64(m.MessageID),
+		UncompressedSize: uint64(m.UncompressedByteSize),
+		CompressedSize:   uint64(m.CompressedByteSize),
+	}
+}
+
+func (c *converter) convertToLinks(b *spanBuf, links []trace.Link) *traceproto.Span_Links {
+	if len(links) == 0 {
+		return nil
+	}
+
+	pl := &traceproto.Span_Links{
+		Link: make([]*traceproto.Span_Link, 0, len(links)),
+	}
+	for i := range links {
+		l := c.convertLink(b, &links[i])
+		if l == nil {
+			pl.DroppedLinksCount++
+			continue
+		}
+		pl.Link = append(pl.Link, l)
+	}
+	return pl
+}
+
+// convertLink converts l, or returns nil if its type is unknown.
+func (c *converter) convertLink(b *spanBuf, l *trace.Link) *traceproto.Span_Link {
+	var typ traceproto.Span_Link_Type
+	switch l.Type {
+	case trace.LinkTypeChild:
+		typ = traceproto.Span_Link_CHILD_LINKED_SPAN
+	case trace.LinkTypeParent:
+		typ = traceproto.Span_Link_PARENT_LINKED_SPAN
+	case trace.LinkTypeUnspecified:
+		typ = traceproto.Span_Link_TYPE_UNSPECIFIED
+	default:
+		return nil
+	}
+
+	pl := &traceproto.Span_Link{
+		TraceId: make([]byte, len(l.TraceID)),
+		SpanId:  make([]byte, len(l.SpanID)),
+		Type:    typ,
+	}
+	copy(pl.TraceId, l.TraceID[:])
+	copy(pl.SpanId, l.SpanID[:])
+	if len(l.Attributes) > 0 {
+		pl.Attributes = c.convertToAttributes(b, new(traceproto.Span_Attributes), l.Attributes)
+	}
+	return pl
+}
+
+// timestampProto converts t to a protobuf Timestamp.
+func timestampProto(t time.Time) *timestamp.Timestamp {
+	ts := new(timestamp.Timestamp)
+	setTimestamp(ts, t)
+	return ts
+}
+
+func setTimestamp(dst *timestamp.Timestamp, t time.Time) {
+	*dst = timestamp.Timestamp{
+		Seconds: t.Unix(),
+		Nanos:   int32(t.Nanosecond()),
+	}
+}
+
 func spanKind(s *trace.SpanData) traceproto.Span_SpanKind {
 	switch s.SpanKind {
 	case trace.SpanKindClient:
@@ -0,0 +1,350 @@
+package agent
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"go.opencensus.io/trace"
+)
+
+func testConverter() *converter {
+	return &converter{
+		limits:  DefaultSpanLimits,
+		logger:  NopLogger(),
+		onError: func(error) {},
+	}
+}
+
+func TestProtoSpanRoundTrip(t *testing.T) {
+	var (
+		traceID = trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		spanID  = trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+		parent  = trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1}
+		start   = time.Date(2018, 6, 1, 12, 0, 0, 123456789, time.UTC)
+		end     = start.Add(1500 * time.Millisecond)
+	)
+	span := func(f func(s *trace.SpanData)) *trace.SpanData {
+		s := &trace.SpanData{
+			SpanContext: trace.SpanContext{
+				TraceID:      traceID,
+				SpanID:       spanID,
+				TraceOptions: 1,
+			},
+			Name:      "span",
+			StartTime: start,
+			EndTime:   end,
+		}
+		if f != nil {
+			f(s)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		in   *trace.SpanData
+		// want is the expected result when it differs from in.
+		want *trace.SpanData
+	}{
+		{
+			name: "minimal",
+			in:   span(nil),
+		},
+		{
+			name: "sub-second timestamps",
+			in: span(func(s *trace.SpanData) {
+				s.StartTime = time.Date(1999, 12, 31, 23, 59, 59, 999999999, time.UTC)
+				s.EndTime = time.Date(2000, 1, 1, 0, 0, 0, 1, time.UTC)
+			}),
+		},
+		{
+			name: "server kind",
+			in:   span(func(s *trace.SpanData) { s.SpanKind = trace.SpanKindServer }),
+		},
+		{
+			name: "client kind",
+			in:   span(func(s *trace.SpanData) { s.SpanKind = trace.SpanKindClient }),
+		},
+		{
+			name: "status",
+			in: span(func(s *trace.SpanData) {
+				s.Status = trace.Status{Code: trace.StatusCodeNotFound, Message: "no such row"}
+			}),
+		},
+		{
+			name: "local parent",
+			in:   span(func(s *trace.SpanData) { s.ParentSpanID = parent }),
+		},
+		{
+			name: "remote parent",
+			in: span(func(s *trace.SpanData) {
+				s.ParentSpanID = parent
+				s.HasRemoteParent = true
+			}),
+		},
+		{
+			name: "attributes",
+			in: span(func(s *trace.SpanData) {
+				s.Attributes = map[string]interface{}{
+					"string": "value",
+					"int":    int64(-42),
+					"bool":   true,
+				}
+			}),
+		},
+		{
+			name: "widened and stringified attributes",
+			in: span(func(s *trace.SpanData) {
+				s.Attributes = map[string]interface{}{
+					"int32":  int32(7),
+					"uint64": uint64(1 << 63),
+					"float":  0.1,
+				}
+			}),
+			want: span(func(s *trace.SpanData) {
+				s.Attributes = map[string]interface{}{
+					"int32":  int64(7),
+					"uint64": "9223372036854775808",
+					"float":  "0.1",
+				}
+			}),
+		},
+		{
+			name: "annotations",
+			in: span(func(s *trace.SpanData) {
+				s.Annotations = []trace.Annotation{
+					{Time: start.Add(time.Millisecond), Message: "cache miss"},
+					{
+						Time:       start.Add(time.Microsecond),
+						Message:    "Annotate",
+						Attributes: map[string]interface{}{"query": "SELECT 1"},
+					},
+				}
+			}),
+		},
+		{
+			name: "message events",
+			in: span(func(s *trace.SpanData) {
+				s.MessageEvents = []trace.MessageEvent{
+					{
+						Time:                 start.Add(time.Nanosecond),
+						EventType:            trace.MessageEventTypeSent,
+						MessageID:            1,
+						UncompressedByteSize: 1024,
+						CompressedByteSize:   512,
+					},
+					{
+						Time:                 end,
+						EventType:            trace.MessageEventTypeRecv,
+						MessageID:            2,
+						UncompressedByteSize: 64,
+						CompressedByteSize:   64,
+					},
+				}
+			}),
+		},
+		{
+			name: "links",
+			in: span(func(s *trace.SpanData) {
+				s.Links = []trace.Link{
+					{TraceID: traceID, SpanID: parent, Type: trace.LinkTypeParent},
+					{
+						TraceID:    trace.TraceID{16},
+						SpanID:     trace.SpanID{8},
+						Type:       trace.LinkTypeChild,
+						Attributes: map[string]interface{}{"batch": int64(3)},
+					},
+				}
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == nil {
+				want = tt.in
+			}
+			got, err := FromProtoSpan(testConverter().toProtoSpan(nil, tt.in))
+			if err != nil {
+				t.Fatalf("FromProtoSpan: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip:\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestAnnotationKeys(t *testing.T) {
+	c := testConverter()
+	c.annotationKeys = map[string]string{"query": "db.statement", "rows": "db.rows"}
+
+	s := &trace.SpanData{
+		Attributes: map[string]interface{}{"db.rows": int64(1)},
+		Annotations: []trace.Annotation{
+			{Message: "first", Attributes: map[string]interface{}{"query": "SELECT 1", "rows": int64(2)}},
+			{Message: "second", Attributes: map[string]interface{}{"query": "SELECT 2"}},
+			{Message: "third", Attributes: map[string]interface{}{"other": "x"}},
+		},
+	}
+	got, err := FromProtoSpan(c.toProtoSpan(nil, s))
+	if err != nil {
+		t.Fatalf("FromProtoSpan: %v", err)
+	}
+	wantAttrs := map[string]interface{}{
+		"db.rows":      int64(1),
+		"db.statement": "SELECT 2",
+	}
+	if !reflect.DeepEqual(got.Attributes, wantAttrs) {
+		t.Errorf("span attributes = %v, want %v", got.Attributes, wantAttrs)
+	}
+	for i, a := range got.Annotations {
+		if !reflect.DeepEqual(a.Attributes, s.Annotations[i].Attributes) {
+			t.Errorf("annotation %d attributes = %v, want %v", i, a.Attributes, s.Annotations[i].Attributes)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+		// truncated is the TruncatedByteCount.
+		truncated int32
+	}{
+		{"abc", 0, "abc", 0},
+		{"abc", 3, "abc", 0},
+		{"abc", 2, "ab", 1},
+		// 中, 文 and 字 take 3 bytes each.
+		{"ab中文字", 5, "ab中", 6},
+		{"ab中文字", 4, "ab", 9},
+		{"中", 2, "", 3},
+	}
+	for _, tt := range tests {
+		c := testConverter()
+		c.limits.MaxStringBytes = tt.max
+		var got traceproto.TruncatableString
+		c.truncate(&got, tt.s)
+		if got.Value != tt.want || got.TruncatedByteCount != tt.truncated {
+			t.Errorf("truncate(%q) with max %d = %q, %d truncated; want %q, %d", tt.s, tt.max, got.Value, got.TruncatedByteCount, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestSpanLimits(t *testing.T) {
+	c := testConverter()
+	c.limits = SpanLimits{MaxAttributes: 3, MaxAnnotations: 2, MaxStringBytes: 5}
+	s := &trace.SpanData{
+		Name: "ab中文字",
+		Attributes: map[string]interface{}{
+			"e": int64(5), "a": int64(1), "d": int64(4), "c": int64(3), "b": int64(2),
+		},
+		Status: trace.Status{Message: "ab中文字"},
+	}
+	for _, msg := range []string{"1", "2", "3", "4", "5"} {
+		s.Annotations = append(s.Annotations, trace.Annotation{Message: msg})
+	}
+	sp := c.toProtoSpan(nil, s)
+
+	if got := sp.Name.TruncatedByteCount; got != 6 {
+		t.Errorf("name TruncatedByteCount = %d, want 6", got)
+	}
+	if got := sp.Status.Message; got != "ab中" {
+		t.Errorf("status message = %q, want %q", got, "ab中")
+	}
+
+	// The first keys in lexical order are kept.
+	var keys []string
+	for k := range sp.Attributes.AttributeMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("attributes %v, want %v", keys, want)
+	}
+	if got := sp.Attributes.DroppedAttributesCount; got != 2 {
+		t.Errorf("DroppedAttributesCount = %d, want 2", got)
+	}
+
+	// The most recent annotations are kept.
+	var msgs []string
+	for _, ev := range sp.TimeEvents.TimeEvent {
+		msgs = append(msgs, ev.GetAnnotation().Description.Value)
+	}
+	if want := []string{"4", "5"}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("annotations %v, want %v", msgs, want)
+	}
+	if got := sp.TimeEvents.DroppedAnnotationsCount; got != 3 {
+		t.Errorf("DroppedAnnotationsCount = %d, want 3", got)
+	}
+}
+
+func TestFromProtoSpanInvalidID(t *testing.T) {
+	sp := &traceproto.Span{
+		TraceId: make([]byte, 16),
+		SpanId:  make([]byte, 4),
+	}
+	if _, err := FromProtoSpan(sp); err == nil {
+		t.Error("FromProtoSpan with a 4-byte span ID: got no error")
+	}
+}
+
+func benchmarkSpan() *trace.SpanData {
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		ParentSpanID: trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+		SpanKind:     trace.SpanKindClient,
+		Name:         "select",
+		StartTime:    start,
+		EndTime:      start.Add(25 * time.Millisecond),
+		Attributes: map[string]interface{}{
+			"service_name": "20180925-neo",
+			"remote_kind":  "mysql",
+			"source":       "web",
+			"hostname":     "fake-hostname-1",
+			"uid":          int64(123456),
+			"cached":       false,
+		},
+		Annotations: []trace.Annotation{
+			{Time: start, Message: "Annotate", Attributes: map[string]interface{}{"query": "select * from profile where uid=123456"}},
+			{Time: start.Add(time.Millisecond), Message: "rows", Attributes: map[string]interface{}{"count": int64(1)}},
+		},
+		MessageEvents: []trace.MessageEvent{
+			{Time: start, EventType: trace.MessageEventTypeSent, MessageID: 1, UncompressedByteSize: 128},
+			{Time: start.Add(24 * time.Millisecond), EventType: trace.MessageEventTypeRecv, MessageID: 1, UncompressedByteSize: 2048},
+		},
+		Status: trace.Status{Message: "ok"},
+	}
+}
+
+// BenchmarkToProtoSpan converts spans into new buffers.
+func BenchmarkToProtoSpan(b *testing.B) {
+	c := testConverter()
+	s := benchmarkSpan()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.toProtoSpan(nil, s)
+	}
+}
+
+// BenchmarkToProtoSpanPooled converts spans into pooled buffers, as
+// uploadSpans does.
+func BenchmarkToProtoSpanPooled(b *testing.B) {
+	c := testConverter()
+	s := benchmarkSpan()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getSpanBuf()
+		c.toProtoSpan(buf, s)
+		putSpanBuf(buf)
+	}
+}
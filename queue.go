@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/golang/protobuf/proto"
+)
+
+// retryQueue is a bounded FIFO of span batches that could not be sent to the
+// agent. Batches are evicted oldest first once their total encoded size
+// exceeds maxBytes, or once they have waited longer than maxAge.
+type retryQueue struct {
+	mu       sync.Mutex
+	batches  []*retryBatch
+	bytes    int
+	spans    int
+	maxBytes int
+	maxAge   time.Duration
+}
+
+type retryBatch struct {
+	req      *exporterproto.ExportSpanRequest
+	size     int
+	enqueued time.Time
+}
+
+func newRetryQueue(maxBytes int, maxAge time.Duration) *retryQueue {
+	return &retryQueue{
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+}
+
+// push appends req to the queue and returns the batches evicted to make room
+// for it, which may include req itself if it alone exceeds maxBytes.
+func (q *retryQueue) push(req *exporterproto.ExportSpanRequest) []*exporterproto.ExportSpanRequest {
+	size := proto.Size(req)
+	if size > q.maxBytes {
+		return []*exporterproto.ExportSpanRequest{req}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var evicted []*exporterproto.ExportSpanRequest
+	for len(q.batches) > 0 && q.bytes+size > q.maxBytes {
+		evicted = append(evicted, q.popLocked().req)
+	}
+
+	q.batches = append(q.batches, &retryBatch{
+		req:      req,
+		size:     size,
+		enqueued: time.Now(),
+	})
+	q.bytes += size
+	q.spans += len(req.Spans)
+
+	return evicted
+}
+
+// expire removes and returns the batches queued for longer than maxAge.
+func (q *retryQueue) expire(now time.Time) []*exporterproto.ExportSpanRequest {
+	if q.maxAge <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expired []*exporterproto.ExportSpanRequest
+	for len(q.batches) > 0 && now.Sub(q.batches[0].enqueued) > q.maxAge {
+		expired = append(expired, q.popLocked().req)
+	}
+	return expired
+}
+
+// front returns the oldest batch without removing it, or nil if the queue is
+// empty.
+func (q *retryQueue) front() *exporterproto.ExportSpanRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) == 0 {
+		return nil
+	}
+	return q.batches[0].req
+}
+
+// pop removes the oldest batch.
+func (q *retryQueue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) > 0 {
+		q.popLocked()
+	}
+}
+
+func (q *retryQueue) popLocked() *retryBatch {
+	b := q.batches[0]
+	q.batches[0] = nil
+	q.batches = q.batches[1:]
+	q.bytes -= b.size
+	q.spans -= len(b.req.Spans)
+	return b
+}
+
+// pendingSpans returns the number of spans in the queued batches.
+func (q *retryQueue) pendingSpans() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.spans
+}
+
+// pendingBytes returns the encoded size of the queued batches.
+func (q *retryQueue) pendingBytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/proto"
+)
+
+// queueRequest returns a request of n spans, whose name is its id.
+func queueRequest(id string, n int) *exporterproto.ExportSpanRequest {
+	req := &exporterproto.ExportSpanRequest{}
+	for i := 0; i < n; i++ {
+		req.Spans = append(req.Spans, &traceproto.Span{
+			Name: &traceproto.TruncatableString{Value: id},
+		})
+	}
+	return req
+}
+
+func requestIDs(reqs []*exporterproto.ExportSpanRequest) string {
+	ids := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		ids = append(ids, req.Spans[0].Name.Value)
+	}
+	return fmt.Sprint(ids)
+}
+
+func checkPending(t *testing.T, q *retryQueue, spans int, reqs ...*exporterproto.ExportSpanRequest) {
+	t.Helper()
+	var bytes int
+	for _, req := range reqs {
+		bytes += proto.Size(req)
+	}
+	if got := q.pendingSpans(); got != spans {
+		t.Errorf("pendingSpans() = %d, want %d", got, spans)
+	}
+	if got := q.pendingBytes(); got != bytes {
+		t.Errorf("pendingBytes() = %d, want %d", got, bytes)
+	}
+}
+
+func TestRetryQueuePushEvictsOldestFirst(t *testing.T) {
+	a, b, c := queueRequest("a", 1), queueRequest("b", 2), queueRequest("c", 3)
+	// Room for a and b, or b and c, not for all three.
+	q := newRetryQueue(proto.Size(b)+proto.Size(c), 0)
+
+	for _, req := range []*exporterproto.ExportSpanRequest{a, b} {
+		if evicted := q.push(req); len(evicted) != 0 {
+			t.Fatalf("push: evicted %s, want none", requestIDs(evicted))
+		}
+	}
+	checkPending(t, q, 3, a, b)
+
+	if evicted := q.push(c); requestIDs(evicted) != "[a]" {
+		t.Errorf("push(c) evicted %s, want [a]", requestIDs(evicted))
+	}
+	checkPending(t, q, 5, b, c)
+	if q.front() != b {
+		t.Errorf("front() = %s, want b", requestIDs([]*exporterproto.ExportSpanRequest{q.front()}))
+	}
+}
+
+func TestRetryQueuePushTooLarge(t *testing.T) {
+	a, big := queueRequest("a", 1), queueRequest("big", 50)
+	q := newRetryQueue(proto.Size(big)-1, 0)
+	q.push(a)
+
+	// A batch that cannot fit is rejected on its own, the queue is kept.
+	if evicted := q.push(big); len(evicted) != 1 || evicted[0] != big {
+		t.Errorf("push(big) evicted %s, want [big]", requestIDs(evicted))
+	}
+	checkPending(t, q, 1, a)
+}
+
+func TestRetryQueueExpire(t *testing.T) {
+	a, b, c := queueRequest("a", 1), queueRequest("b", 1), queueRequest("c", 1)
+	q := newRetryQueue(1<<20, time.Minute)
+	for _, req := range []*exporterproto.ExportSpanRequest{a, b, c} {
+		q.push(req)
+	}
+	now := time.Now()
+	q.batches[0].enqueued = now.Add(-3 * time.Minute)
+	q.batches[1].enqueued = now.Add(-2 * time.Minute)
+	q.batches[2].enqueued = now.Add(-30 * time.Second)
+
+	if expired := q.expire(now); requestIDs(expired) != "[a b]" {
+		t.Errorf("expire() = %s, want [a b]", requestIDs(expired))
+	}
+	checkPending(t, q, 1, c)
+	if expired := q.expire(now.Add(time.Minute)); requestIDs(expired) != "[c]" {
+		t.Errorf("expire() a minute later = %s, want [c]", requestIDs(expired))
+	}
+	checkPending(t, q, 0)
+}
+
+func TestRetryQueueNoMaxAge(t *testing.T) {
+	q := newRetryQueue(1<<20, 0)
+	q.push(queueRequest("a", 1))
+	if expired := q.expire(time.Now().Add(24 * time.Hour)); len(expired) != 0 {
+		t.Errorf("expire() without max age = %s, want none", requestIDs(expired))
+	}
+}
+
+func TestRetryQueuePop(t *testing.T) {
+	a, b := queueRequest("a", 2), queueRequest("b", 3)
+	q := newRetryQueue(1<<20, 0)
+	q.push(a)
+	q.push(b)
+
+	q.pop()
+	checkPending(t, q, 3, b)
+	if q.front() != b {
+		t.Error("front() after pop is not b")
+	}
+	q.pop()
+	checkPending(t, q, 0)
+	if q.front() != nil {
+		t.Error("front() of an empty queue is not nil")
+	}
+	// Popping an empty queue is a no-op.
+	q.pop()
+	checkPending(t, q, 0)
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/stats"
+)
+
+const reasonTooLarge = "too large"
+
+// spanFieldSize is the size a span of encoded size n takes in a request.
+func spanFieldSize(n int) int {
+	return 1 + proto.SizeVarint(uint64(n)) + n
+}
+
+// fitSpans returns how many of the first spans fit in a request of at most
+// maxMessageSize bytes, at least one.
+func (e *Exporter) fitSpans(spans []*spanBuf) int {
+	size := 0
+	for i, s := range spans {
+		size += spanFieldSize(s.size)
+		if size > e.maxMessageSize && i > 0 {
+			return i
+		}
+	}
+	return len(spans)
+}
+
+// fitSpan makes sure the span in b can be sent on its own in a request of at
+// most maxMessageSize bytes, by dropping its stack trace, then its oldest
+// time events, then its links and then its attributes, until it fits. It
+// reports whether the span fits, updating b.size; the span is left truncated
+// otherwise.
+func (e *Exporter) fitSpan(b *spanBuf) bool {
+	if spanFieldSize(b.size) <= e.maxMessageSize {
+		return true
+	}
+	sp := &b.span
+	fits := func() bool {
+		b.size = proto.Size(sp)
+		return spanFieldSize(b.size) <= e.maxMessageSize
+	}
+
+	e.logger.Warn("span exceeds the maximum message size, truncating",
+		"span_id", fmt.Sprintf("%x", sp.SpanId), "size", b.size, "max", e.maxMessageSize)
+	stats.Record(context.Background(), SpansTruncated.M(1))
+	e.debugMu.Lock()
+	e.truncatedSpans++
+	e.debugMu.Unlock()
+
+	sp.StackTrace = nil
+	if fits() {
+		return true
+	}
+
+	if te := sp.TimeEvents; te != nil {
+		excess := spanFieldSize(b.size) - e.maxMessageSize
+		n := 0
+		for n < len(te.TimeEvent) && excess > 0 {
+			excess -= spanFieldSize(proto.Size(te.TimeEvent[n]))
+			n++
+		}
+		for _, ev := range te.TimeEvent[:n] {
+			switch ev.Value.(type) {
+			case *traceproto.Span_TimeEvent_Annotation_:
+				te.DroppedAnnotationsCount++
+			case *traceproto.Span_TimeEvent_MessageEvent_:
+				te.DroppedMessageEventsCount++
+			}
+		}
+		te.TimeEvent = te.TimeEvent[n:]
+		if fits() {
+			return true
+		}
+	}
+
+	if l := sp.Links; l != nil {
+		l.DroppedLinksCount += int32(len(l.Link))
+		l.Link = nil
+		if fits() {
+			return true
+		}
+	}
+
+	if a := sp.Attributes; a != nil {
+		a.DroppedAttributesCount += int32(len(a.AttributeMap))
+		a.AttributeMap = nil
+	}
+	return fits()
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/trace"
+)
+
+func testExporter(maxMessageSize int) *Exporter {
+	return &Exporter{
+		options: &options{
+			maxMessageSize: maxMessageSize,
+			logger:         NopLogger(),
+		},
+	}
+}
+
+func requestSize(spans ...*traceproto.Span) int {
+	return proto.Size(&exporterproto.ExportSpanRequest{Spans: spans})
+}
+
+// splitTestSpan returns a span with a stack trace, 3 annotations and a
+// message event, 2 links and 5 attributes, converted into a new buffer.
+func splitTestSpan() *spanBuf {
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := &trace.SpanData{
+		SpanContext: trace.SpanContext{SpanID: trace.SpanID{1}},
+		Name:        "span",
+		StartTime:   start,
+		EndTime:     start.Add(time.Second),
+		Attributes: map[string]interface{}{
+			"a": "1", "b": "2", "c": "3", "d": "4", "e": "5",
+		},
+		Annotations: []trace.Annotation{
+			{Time: start, Message: strings.Repeat("1", 200)},
+			{Time: start, Message: strings.Repeat("2", 200)},
+			{Time: start, Message: strings.Repeat("3", 200)},
+		},
+		MessageEvents: []trace.MessageEvent{
+			{Time: start, EventType: trace.MessageEventTypeSent, MessageID: 1},
+		},
+		Links: []trace.Link{
+			{SpanID: trace.SpanID{2}, Type: trace.LinkTypeParent},
+			{SpanID: trace.SpanID{3}, Type: trace.LinkTypeChild},
+		},
+	}
+	b := new(spanBuf)
+	sp := testConverter().toProtoSpan(b, s)
+	sp.StackTrace = captureStack(1)
+	b.size = proto.Size(sp)
+	return b
+}
+
+func TestFitSpan(t *testing.T) {
+	// strip applies to a copy of the test span what the truncation is
+	// expected to do to take it under the size limit, dropped counts included.
+	type strip func(sp *traceproto.Span)
+	var (
+		stack = func(sp *traceproto.Span) { sp.StackTrace = nil }
+		// events drops the n oldest time events, of which ann annotations.
+		events = func(n, ann int) strip {
+			return func(sp *traceproto.Span) {
+				te := *sp.TimeEvents
+				te.TimeEvent = te.TimeEvent[n:]
+				te.DroppedAnnotationsCount = int32(ann)
+				te.DroppedMessageEventsCount = int32(n - ann)
+				sp.TimeEvents = &te
+			}
+		}
+		links = func(sp *traceproto.Span) {
+			sp.Links = &traceproto.Span_Links{DroppedLinksCount: int32(len(sp.Links.Link))}
+		}
+		attrs = func(sp *traceproto.Span) {
+			sp.Attributes = &traceproto.Span_Attributes{DroppedAttributesCount: int32(len(sp.Attributes.AttributeMap))}
+		}
+	)
+
+	tests := []struct {
+		name  string
+		strip []strip
+		// slack is added to the size of the stripped span to get the limit.
+		slack int
+		want  bool
+
+		stack                          bool
+		events, droppedAnn, droppedMsg int
+		links, droppedLinks            int
+		attributes, droppedAttributes  int
+	}{
+		{name: "fits", want: true, stack: true, events: 4, links: 2, attributes: 5},
+		{name: "stack", strip: []strip{stack}, want: true, events: 4, links: 2, attributes: 5},
+		{name: "oldest event", strip: []strip{stack, events(1, 1)}, want: true, events: 3, droppedAnn: 1, links: 2, attributes: 5},
+		{name: "oldest events", strip: []strip{stack, events(2, 2)}, want: true, events: 2, droppedAnn: 2, links: 2, attributes: 5},
+		{name: "all events", strip: []strip{stack, events(4, 3)}, want: true, droppedAnn: 3, droppedMsg: 1, links: 2, attributes: 5},
+		{name: "links", strip: []strip{stack, events(4, 3), links}, want: true, droppedAnn: 3, droppedMsg: 1, droppedLinks: 2, attributes: 5},
+		{name: "attributes", strip: []strip{stack, events(4, 3), links, attrs}, want: true, droppedAnn: 3, droppedMsg: 1, droppedLinks: 2, droppedAttributes: 5},
+		{name: "too large", strip: []strip{stack, events(4, 3), links, attrs}, slack: -1, droppedAnn: 3, droppedMsg: 1, droppedLinks: 2, droppedAttributes: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := splitTestSpan()
+			stripped := b.span
+			for _, f := range tt.strip {
+				f(&stripped)
+			}
+			max := requestSize(&stripped) + tt.slack
+			e := testExporter(max)
+
+			if got := e.fitSpan(b); got != tt.want {
+				t.Fatalf("fitSpan() = %v, want %v", got, tt.want)
+			}
+			sp := &b.span
+			if b.size != proto.Size(sp) {
+				t.Errorf("size = %d, want %d", b.size, proto.Size(sp))
+			}
+			if got := requestSize(sp); tt.want && got > max {
+				t.Errorf("request size = %d, over the %d limit", got, max)
+			}
+
+			if (sp.StackTrace != nil) != tt.stack {
+				t.Errorf("has stack trace = %v, want %v", sp.StackTrace != nil, tt.stack)
+			}
+			te := sp.TimeEvents
+			if len(te.TimeEvent) != tt.events || int(te.DroppedAnnotationsCount) != tt.droppedAnn || int(te.DroppedMessageEventsCount) != tt.droppedMsg {
+				t.Errorf("%d time events, %d and %d dropped; want %d, %d and %d",
+					len(te.TimeEvent), te.DroppedAnnotationsCount, te.DroppedMessageEventsCount,
+					tt.events, tt.droppedAnn, tt.droppedMsg)
+			}
+			if n := len(te.TimeEvent); n > 0 && n < 4 {
+				// The most recent events are kept.
+				if te.TimeEvent[n-1].GetMessageEvent() == nil {
+					t.Error("the message event, most recent, was dropped")
+				}
+			}
+			if len(sp.Links.Link) != tt.links || int(sp.Links.DroppedLinksCount) != tt.droppedLinks {
+				t.Errorf("%d links, %d dropped; want %d, %d",
+					len(sp.Links.Link), sp.Links.DroppedLinksCount, tt.links, tt.droppedLinks)
+			}
+			a := sp.Attributes
+			if len(a.AttributeMap) != tt.attributes || int(a.DroppedAttributesCount) != tt.droppedAttributes {
+				t.Errorf("%d attributes, %d dropped; want %d, %d",
+					len(a.AttributeMap), a.DroppedAttributesCount, tt.attributes, tt.droppedAttributes)
+			}
+
+			truncated := int64(0)
+			if len(tt.strip) > 0 {
+				truncated = 1
+			}
+			if e.truncatedSpans != truncated {
+				t.Errorf("truncatedSpans = %d, want %d", e.truncatedSpans, truncated)
+			}
+		})
+	}
+}
+
+func TestFitSpans(t *testing.T) {
+	sizes := []int{10, 200, 3000, 50, 70000}
+	spans := make([]*spanBuf, len(sizes))
+	for i, n := range sizes {
+		b := new(spanBuf)
+		b.span.Name = &traceproto.TruncatableString{Value: strings.Repeat("x", n)}
+		b.size = proto.Size(&b.span)
+		spans[i] = b
+	}
+	protoSpans := func(bufs []*spanBuf) []*traceproto.Span {
+		s := make([]*traceproto.Span, len(bufs))
+		for i, b := range bufs {
+			s[i] = &b.span
+		}
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		spans []*spanBuf
+		max   int
+		want  int
+	}{
+		{"all", spans[:4], requestSize(protoSpans(spans[:4])...), 4},
+		{"one byte short", spans[:4], requestSize(protoSpans(spans[:4])...) - 1, 3},
+		{"first two", spans, requestSize(protoSpans(spans[:2])...), 2},
+		{"first alone", spans, requestSize(protoSpans(spans[:1])...), 1},
+		// The first span is always taken: fitSpan made it fit.
+		{"first too large", spans[4:], 100, 1},
+		{"none", nil, 100, 0},
+	}
+	for _, tt := range tests {
+		e := testExporter(tt.max)
+		got := e.fitSpans(tt.spans)
+		if got != tt.want {
+			t.Errorf("%s: fitSpans() = %d, want %d", tt.name, got, tt.want)
+			continue
+		}
+		// The size computed for the request is exact.
+		var size int
+		for _, b := range tt.spans[:got] {
+			size += spanFieldSize(b.size)
+		}
+		if want := requestSize(protoSpans(tt.spans[:got])...); size != want {
+			t.Errorf("%s: computed request size %d, proto.Size %d", tt.name, size, want)
+		}
+	}
+}
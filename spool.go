@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	spoolSegmentExt = ".seg"
+	// spoolSegmentBytes is the size at which the spool starts a new segment
+	// file. Space is reclaimed one whole segment at a time.
+	spoolSegmentBytes = 4 * 1024 * 1024
+	// spoolHeaderBytes is the size of a record header: the payload length
+	// followed by the CRC-32 (Castagnoli) of the payload.
+	spoolHeaderBytes = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errSpoolRecordTooLarge = errors.New("record exceeds spool size limit")
+	errSpoolClosed         = errors.New("spool is closed")
+)
+
+// spool is an on-disk write-ahead log of serialized ExportSpanRequests that
+// could not be delivered to the agent.
+//
+// It is made of numbered segment files in dir, each holding a sequence of
+// length and checksum prefixed records. Records are appended to the newest
+// segment and read back from the oldest one. A segment is deleted once it has
+// been replayed, or when the total size would exceed maxBytes, in which case
+// its spans are lost. A truncated or corrupted record makes the reader skip
+// the rest of its segment, so a crash while writing loses at most that tail.
+//
+// Replay progress is only kept in memory: after a restart, a partially
+// replayed segment is replayed again from its beginning.
+type spool struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	segments []*spoolSegment // oldest first
+	size     int64           // total size of segments
+	nextSeq  uint64
+
+	w       *os.File      // appends to the newest segment, if opened by us
+	wseg    *spoolSegment // segment w writes to
+	readOff int64         // offset of the next record to replay in segments[0]
+	closed  bool
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// spoolRecord is a record handed out by next, along with its position.
+type spoolRecord struct {
+	payload []byte
+	seq     uint64
+	off     int64
+}
+
+// openSpool opens the spool in dir, creating the directory if needed, and
+// picks up the segments left by a previous process.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("spool size limit must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: spoolSegmentBytes,
+	}
+	if s.segmentBytes > maxBytes/4 {
+		s.segmentBytes = maxBytes / 4
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{
+			seq:  seq,
+			path: filepath.Join(dir, name),
+			size: fi.Size(),
+		})
+		s.size += fi.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+	if n := len(s.segments); n > 0 {
+		s.nextSeq = s.segments[n-1].seq + 1
+	}
+
+	return s, nil
+}
+
+// write appends payload as a new record. To stay within maxBytes it may delete
+// the oldest segments; the number of spans they held is returned.
+func (s *spool) write(payload []byte) (dropped int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errSpoolClosed
+	}
+
+	n := int64(spoolHeaderBytes + len(payload))
+	if n > s.maxBytes {
+		return 0, errSpoolRecordTooLarge
+	}
+
+	for len(s.segments) > 0 && s.size+n > s.maxBytes {
+		dropped += s.evictLocked()
+	}
+
+	if s.w == nil || s.wseg.size >= s.segmentBytes {
+		if err := s.rotateLocked(); err != nil {
+			return dropped, err
+		}
+	}
+
+	rec := make([]byte, n)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(payload, crcTable))
+	copy(rec[spoolHeaderBytes:], payload)
+
+	if _, err := s.w.Write(rec); err != nil {
+		// The segment may now end with a partial record, don't append to it.
+		s.closeWriterLocked()
+		return dropped, err
+	}
+	if err := s.w.Sync(); err != nil {
+		s.closeWriterLocked()
+		return dropped, err
+	}
+	s.wseg.size += n
+	s.size += n
+
+	return dropped, nil
+}
+
+// next returns the oldest record not replayed yet, or nil if there is none.
+// The record stays in the spool until commit is called.
+func (s *spool) next() (*spoolRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.readOff >= seg.size {
+			if seg == s.wseg {
+				return nil, nil
+			}
+			s.removeFirstLocked()
+			continue
+		}
+
+		payload, err := s.readLocked(seg, s.readOff)
+		if err == nil {
+			return &spoolRecord{payload: payload, seq: seg.seq, off: s.readOff}, nil
+		}
+
+		// Skip whatever is left of a damaged segment.
+		if seg == s.wseg {
+			s.closeWriterLocked()
+		}
+		s.removeFirstLocked()
+		return nil, fmt.Errorf("spool: skipped damaged segment %s: %v", seg.path, err)
+	}
+	return nil, nil
+}
+
+// commit marks rec as replayed. It does nothing if rec has been evicted in
+// the meantime.
+func (s *spool) commit(rec *spoolRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0].seq != rec.seq || s.readOff != rec.off {
+		return
+	}
+
+	s.readOff += int64(spoolHeaderBytes + len(rec.payload))
+	if s.segments[0] != s.wseg && s.readOff >= s.segments[0].size {
+		s.removeFirstLocked()
+	}
+}
+
+// close closes the segment being written. Writing to the spool fails after,
+// reading from it still works.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	s.wseg = nil
+	return err
+}
+
+// bytes returns the total size of the spool files.
+func (s *spool) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *spool) readLocked(seg *spoolSegment, off int64) ([]byte, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hdr [spoolHeaderBytes]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return nil, fmt.Errorf("truncated record header at offset %d", off)
+	}
+	length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	if off+spoolHeaderBytes+length > seg.size {
+		return nil, fmt.Errorf("truncated record at offset %d", off)
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+spoolHeaderBytes); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch at offset %d", off)
+	}
+	return payload, nil
+}
+
+// evictLocked deletes the oldest segment and returns the number of spans
+// that had not been replayed from it yet.
+func (s *spool) evictLocked() int {
+	seg := s.segments[0]
+	if seg == s.wseg {
+		s.closeWriterLocked()
+	}
+
+	var spans int
+	for off := s.readOff; off < seg.size; {
+		payload, err := s.readLocked(seg, off)
+		if err != nil {
+			break
+		}
+		var req exporterproto.ExportSpanRequest
+		if proto.Unmarshal(payload, &req) == nil {
+			spans += len(req.Spans)
+		}
+		off += int64(spoolHeaderBytes + len(payload))
+	}
+
+	s.removeFirstLocked()
+	return spans
+}
+
+func (s *spool) removeFirstLocked() {
+	seg := s.segments[0]
+	os.Remove(seg.path)
+	s.segments[0] = nil
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	s.readOff = 0
+}
+
+func (s *spool) rotateLocked() error {
+	s.closeWriterLocked()
+
+	seg := &spoolSegment{
+		seq:  s.nextSeq,
+		path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolSegmentExt)),
+	}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.segments = append(s.segments, seg)
+	s.w = f
+	s.wseg = seg
+	return nil
+}
+
+func (s *spool) closeWriterLocked() {
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.w = nil
+	s.wseg = nil
+}
@@ -0,0 +1,317 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+	"github.com/golang/protobuf/proto"
+)
+
+func tempSpool(t *testing.T, maxBytes, segmentBytes int64) (*spool, string) {
+	dir, err := ioutil.TempDir("", "hunter-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool(dir, maxBytes)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s.segmentBytes = segmentBytes
+	return s, dir
+}
+
+// spoolPayload returns a request of n spans named after id.
+func spoolPayload(t *testing.T, id, n int) []byte {
+	req := &exporterproto.ExportSpanRequest{}
+	for i := 0; i < n; i++ {
+		req.Spans = append(req.Spans, &traceproto.Span{
+			Name: &traceproto.TruncatableString{Value: fmt.Sprintf("req%d-span%d", id, i)},
+		})
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// payloadID returns the id spoolPayload named the spans of payload after.
+func payloadID(t *testing.T, payload []byte) int {
+	var req exporterproto.ExportSpanRequest
+	if err := proto.Unmarshal(payload, &req); err != nil {
+		t.Fatalf("unmarshal record: %v", err)
+	}
+	var id, i int
+	fmt.Sscanf(req.Spans[0].Name.Value, "req%d-span%d", &id, &i)
+	return id
+}
+
+// drain replays the whole spool, returning the ids of the records and the
+// number of errors.
+func drain(t *testing.T, s *spool) (ids []int, errs int) {
+	for i := 0; i < 1000; i++ {
+		rec, err := s.next()
+		if err != nil {
+			errs++
+			continue
+		}
+		if rec == nil {
+			return ids, errs
+		}
+		ids = append(ids, payloadID(t, rec.payload))
+		s.commit(rec)
+	}
+	t.Fatal("spool never drained")
+	return nil, 0
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolRotation(t *testing.T) {
+	p := spoolPayload(t, 0, 2)
+	rec := int64(spoolHeaderBytes + len(p))
+	s, dir := tempSpool(t, 1<<20, 2*rec)
+	defer os.RemoveAll(dir)
+
+	var total int64
+	for id := 0; id < 6; id++ {
+		p := spoolPayload(t, id, 2)
+		total += int64(spoolHeaderBytes + len(p))
+		if dropped, err := s.write(p); err != nil || dropped != 0 {
+			t.Fatalf("write %d: dropped %d, err %v", id, dropped, err)
+		}
+	}
+	if got := s.bytes(); got != total {
+		t.Errorf("bytes() = %d, want %d", got, total)
+	}
+	// A segment holds two records.
+	if got := len(segmentFiles(t, dir)); got != 3 {
+		t.Errorf("%d segment files, want 3", got)
+	}
+
+	ids, errs := drain(t, s)
+	if errs != 0 || fmt.Sprint(ids) != "[0 1 2 3 4 5]" {
+		t.Errorf("replayed %v with %d errors, want [0 1 2 3 4 5]", ids, errs)
+	}
+	// Replayed segments are deleted, except the one being written.
+	if got := len(segmentFiles(t, dir)); got != 1 {
+		t.Errorf("%d segment files after replay, want 1", got)
+	}
+}
+
+func TestSpoolEviction(t *testing.T) {
+	p := spoolPayload(t, 0, 3)
+	rec := int64(spoolHeaderBytes + len(p))
+	// Room for 4 records, in segments of 2.
+	s, dir := tempSpool(t, 4*rec, 2*rec)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 4; id++ {
+		if dropped, err := s.write(spoolPayload(t, id, 3)); err != nil || dropped != 0 {
+			t.Fatalf("write %d: dropped %d, err %v", id, dropped, err)
+		}
+	}
+	// The oldest segment, with records 0 and 1, makes room for record 4.
+	dropped, err := s.write(spoolPayload(t, 4, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 6 {
+		t.Errorf("dropped %d spans, want 6", dropped)
+	}
+	if got := s.bytes(); got > 4*rec {
+		t.Errorf("bytes() = %d, over the %d limit", got, 4*rec)
+	}
+
+	ids, errs := drain(t, s)
+	if errs != 0 || fmt.Sprint(ids) != "[2 3 4]" {
+		t.Errorf("replayed %v with %d errors, want [2 3 4]", ids, errs)
+	}
+}
+
+func TestSpoolEvictionAfterPartialReplay(t *testing.T) {
+	p := spoolPayload(t, 0, 3)
+	rec := int64(spoolHeaderBytes + len(p))
+	s, dir := tempSpool(t, 4*rec, 2*rec)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 4; id++ {
+		if _, err := s.write(spoolPayload(t, id, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := s.next()
+	if err != nil || r == nil {
+		t.Fatalf("next: %v, %v", r, err)
+	}
+	s.commit(r)
+
+	// Record 0 was replayed: only the spans of record 1 are lost.
+	dropped, err := s.write(spoolPayload(t, 4, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 3 {
+		t.Errorf("dropped %d spans, want 3", dropped)
+	}
+}
+
+func TestSpoolCommitAfterEviction(t *testing.T) {
+	p := spoolPayload(t, 0, 1)
+	rec := int64(spoolHeaderBytes + len(p))
+	s, dir := tempSpool(t, 4*rec, 2*rec)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 4; id++ {
+		if _, err := s.write(spoolPayload(t, id, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := s.next()
+	if err != nil || payloadID(t, r.payload) != 0 {
+		t.Fatalf("next: %v", err)
+	}
+
+	// Record 0 is evicted while being replayed: committing it must not
+	// skip record 2, now first.
+	if _, err := s.write(spoolPayload(t, 4, 1)); err != nil {
+		t.Fatal(err)
+	}
+	s.commit(r)
+
+	ids, errs := drain(t, s)
+	if errs != 0 || fmt.Sprint(ids) != "[2 3 4]" {
+		t.Errorf("replayed %v with %d errors, want [2 3 4]", ids, errs)
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	s, dir := tempSpool(t, 1<<20, 100)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 3; id++ {
+		if _, err := s.write(spoolPayload(t, id, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replay record 0, then restart: progress is lost with the process, the
+	// partially replayed segment is replayed from its beginning.
+	r, _ := s.next()
+	s.commit(r)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.write(spoolPayload(t, 9, 1)); err != errSpoolClosed {
+		t.Errorf("write after close: %v, want %v", err, errSpoolClosed)
+	}
+
+	s, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.segmentBytes = 100
+	if _, err := s.write(spoolPayload(t, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, errs := drain(t, s)
+	if errs != 0 || fmt.Sprint(ids) != "[0 1 2 3]" {
+		t.Errorf("replayed %v with %d errors, want [0 1 2 3]", ids, errs)
+	}
+}
+
+func TestSpoolTruncatedRecord(t *testing.T) {
+	s, dir := tempSpool(t, 1<<20, 1<<10)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 3; id++ {
+		if _, err := s.write(spoolPayload(t, id, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.close()
+
+	// A crash in the middle of writing record 2.
+	files := segmentFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("%d segment files, want 1", len(files))
+	}
+	fi, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(files[0], fi.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, errs := drain(t, s)
+	if errs != 1 || fmt.Sprint(ids) != "[0 1]" {
+		t.Errorf("replayed %v with %d errors, want [0 1] with 1 error", ids, errs)
+	}
+	if got := s.bytes(); got != 0 {
+		t.Errorf("bytes() = %d after skipping the damaged segment, want 0", got)
+	}
+}
+
+func TestSpoolBadChecksum(t *testing.T) {
+	p := spoolPayload(t, 0, 2)
+	rec := int64(spoolHeaderBytes + len(p))
+	s, dir := tempSpool(t, 1<<20, 2*rec)
+	defer os.RemoveAll(dir)
+
+	for id := 0; id < 4; id++ {
+		if _, err := s.write(spoolPayload(t, id, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.close()
+
+	// Flip a payload byte of record 1, in the first segment.
+	files := segmentFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("%d segment files, want 2", len(files))
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[rec+spoolHeaderBytes+3] ^= 0xff
+	if err := ioutil.WriteFile(files[0], b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rest of the damaged segment is skipped, the next one is intact.
+	ids, errs := drain(t, s)
+	if errs != 1 || fmt.Sprint(ids) != "[0 2 3]" {
+		t.Errorf("replayed %v with %d errors, want [0 2 3] with 1 error", ids, errs)
+	}
+}
+
+func TestSpoolRecordTooLarge(t *testing.T) {
+	s, dir := tempSpool(t, 64, 16)
+	defer os.RemoveAll(dir)
+
+	if _, err := s.write(make([]byte, 64)); err != errSpoolRecordTooLarge {
+		t.Errorf("write: %v, want %v", err, errSpoolRecordTooLarge)
+	}
+}
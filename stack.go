@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"container/list"
+	"hash/fnv"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/trace"
+
+	"github.com/census-instrumentation/opencensus-proto/gen-go/exporterproto"
+	"github.com/census-instrumentation/opencensus-proto/gen-go/traceproto"
+)
+
+const (
+	// maxStackFrames is the number of frames kept in a stack trace, the
+	// others are counted as dropped.
+	maxStackFrames = 64
+	// maxPendingStacks bounds the stacks captured with CaptureStack that
+	// wait for their span to be exported.
+	maxPendingStacks = 1024
+	// maxSentStacks bounds the stack hashes remembered per stream.
+	maxSentStacks = 4096
+)
+
+// pendingStacks holds the stacks captured by CaptureStack, by span, until
+// the span is exported.
+var pendingStacks = struct {
+	sync.Mutex
+	m     map[trace.SpanID]*list.Element
+	order *list.List // of *pendingStack, oldest first
+}{
+	m:     make(map[trace.SpanID]*list.Element),
+	order: list.New(),
+}
+
+type pendingStack struct {
+	id trace.SpanID
+	st *traceproto.StackTrace
+}
+
+// CaptureStack records the stack of the calling goroutine for span. It is
+// exported with the span to Hunter agent once the span ends, replacing the
+// stack captured because of CaptureStacksOnError if any.
+func CaptureStack(span *trace.Span) {
+	sc := span.SpanContext()
+	if sc.SpanID == (trace.SpanID{}) {
+		return
+	}
+	st := captureStack(2)
+
+	pendingStacks.Lock()
+	defer pendingStacks.Unlock()
+
+	if el, ok := pendingStacks.m[sc.SpanID]; ok {
+		el.Value.(*pendingStack).st = st
+		return
+	}
+	// Stacks of spans that are never exported, e.g. because they are not
+	// sampled, are evicted oldest first.
+	if pendingStacks.order.Len() >= maxPendingStacks {
+		oldest := pendingStacks.order.Remove(pendingStacks.order.Front()).(*pendingStack)
+		delete(pendingStacks.m, oldest.id)
+	}
+	pendingStacks.m[sc.SpanID] = pendingStacks.order.PushBack(&pendingStack{id: sc.SpanID, st: st})
+}
+
+// takeStack returns the stack captured by CaptureStack for the span id, if
+// any, and forgets it.
+func takeStack(id trace.SpanID) *traceproto.StackTrace {
+	pendingStacks.Lock()
+	defer pendingStacks.Unlock()
+
+	el, ok := pendingStacks.m[id]
+	if !ok {
+		return nil
+	}
+	delete(pendingStacks.m, id)
+	return pendingStacks.order.Remove(el).(*pendingStack).st
+}
+
+// captureStack returns the stack of the calling goroutine, skipping skip
+// frames as runtime.Callers does, as well as the frames of ending and
+// exporting the span on top of it when called from ExportSpan.
+func captureStack(skip int) *traceproto.StackTrace {
+	pcs := make([]uintptr, maxStackFrames+32)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	st := &traceproto.StackTrace{
+		StackFrames: &traceproto.StackTrace_StackFrames{},
+	}
+	h := fnv.New64a()
+	top := true
+	for {
+		f, more := frames.Next()
+		pkg := funcPackage(f.Function)
+		if top && isExporterFrame(pkg) {
+			if !more {
+				break
+			}
+			continue
+		}
+		top = false
+
+		if len(st.StackFrames.Frame) < maxStackFrames {
+			st.StackFrames.Frame = append(st.StackFrames.Frame, &traceproto.StackTrace_StackFrame{
+				FunctionName: &traceproto.TruncatableString{Value: f.Function},
+				FileName:     &traceproto.TruncatableString{Value: f.File},
+				LineNumber:   int64(f.Line),
+				LoadModule: &traceproto.Module{
+					Module: &traceproto.TruncatableString{Value: pkg},
+				},
+			})
+			h.Write([]byte(f.Function))
+			h.Write([]byte(f.File))
+			h.Write([]byte(strconv.Itoa(f.Line)))
+		} else {
+			st.StackFrames.DroppedFramesCount++
+		}
+		if !more {
+			break
+		}
+	}
+	// n may have been capped by the size of pcs.
+	if n == len(pcs) {
+		st.StackFrames.DroppedFramesCount++
+	}
+	st.StackTraceHashId = h.Sum64()
+	return st
+}
+
+var thisPackage = reflect.TypeOf(spanBuf{}).PkgPath()
+
+// isExporterFrame reports whether a frame of package pkg is part of ending and
+// exporting a span, rather than of the code that ended it.
+func isExporterFrame(pkg string) bool {
+	return pkg == thisPackage || pkg == "sync" || strings.HasSuffix(pkg, "go.opencensus.io/trace")
+}
+
+// funcPackage returns the import path of the package of the fully qualified
+// function name fn.
+func funcPackage(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+	if dot := strings.Index(fn[slash+1:], "."); dot >= 0 {
+		return fn[:slash+1+dot]
+	}
+	return fn
+}
+
+// dedupStacks returns req, or a copy of it in which the stacks already sent
+// on stream only carry their hash ID, as the agent resolves them from the
+// first occurrence. req itself is left untouched, since it may be resent on
+// another stream.
+//
+// The stacks of req are remembered as sent: if the Send fails, the stream is
+// replaced anyway, which starts over. e.sendMu must be held.
+func (e *Exporter) dedupStacks(stream *spanStream, req *exporterproto.ExportSpanRequest) *exporterproto.ExportSpanRequest {
+	if e.sentStacksStream != stream || len(e.sentStacks) >= maxSentStacks {
+		e.sentStacksStream = stream
+		e.sentStacks = make(map[uint64]bool)
+	}
+
+	out := req
+	for i, sp := range req.Spans {
+		if sp.StackTrace == nil || sp.StackTrace.StackFrames == nil {
+			continue
+		}
+		id := sp.StackTrace.StackTraceHashId
+		if !e.sentStacks[id] {
+			e.sentStacks[id] = true
+			continue
+		}
+		if out == req {
+			out = &exporterproto.ExportSpanRequest{
+				Spans: append([]*traceproto.Span(nil), req.Spans...),
+			}
+		}
+		stripped := *sp
+		stripped.StackTrace = &traceproto.StackTrace{StackTraceHashId: id}
+		out.Spans[i] = &stripped
+	}
+	return out
+}
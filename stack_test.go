@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestPendingStacksEviction(t *testing.T) {
+	spans := make([]*trace.Span, maxPendingStacks+2)
+	for i := range spans {
+		_, spans[i] = trace.StartSpan(context.Background(), "span", trace.WithSampler(trace.AlwaysSample()))
+		CaptureStack(spans[i])
+	}
+	// Capturing again for a pending span replaces its stack in place.
+	CaptureStack(spans[2])
+
+	id := func(i int) trace.SpanID { return spans[i].SpanContext().SpanID }
+	for i := 0; i < 2; i++ {
+		if st := takeStack(id(i)); st != nil {
+			t.Errorf("span %d: stack not evicted", i)
+		}
+	}
+	for i := 2; i < len(spans); i++ {
+		if st := takeStack(id(i)); st == nil {
+			t.Errorf("span %d: no stack", i)
+		}
+		if st := takeStack(id(i)); st != nil {
+			t.Errorf("span %d: stack taken twice", i)
+		}
+	}
+	if len(pendingStacks.m) != 0 || pendingStacks.order.Len() != 0 {
+		t.Errorf("%d stacks, %d in order after taking all, want none", len(pendingStacks.m), pendingStacks.order.Len())
+	}
+}
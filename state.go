@@ -0,0 +1,98 @@
+package agent
+
+import "sync"
+
+// State is the state of the exporter's connection to the Hunter agent.
+type State int
+
+const (
+	// Connecting means the exporter is dialing the agent, spans are
+	// buffered meanwhile.
+	Connecting State = iota
+	// Ready means the span stream to the agent is open, spans are flowing.
+	Ready
+	// TransientFailure means the last attempt to connect failed, the
+	// exporter waits before trying again.
+	TransientFailure
+	// Shutdown means the exporter has been stopped.
+	Shutdown
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	}
+	return "INVALID_STATE"
+}
+
+// State returns the current state of the connection to the agent.
+func (e *Exporter) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state
+}
+
+// setState moves the exporter to state s, and queues the transition for the
+// OnStateChange hook. e.mu must be held.
+func (e *Exporter) setState(s State) {
+	if e.state == s || e.state == Shutdown {
+		return
+	}
+	old := e.state
+	e.state = s
+	if e.onStateChange != nil {
+		e.stateChanges.push(stateChange{old, s})
+	}
+}
+
+type stateChange struct {
+	old, new State
+}
+
+// stateQueue holds the transitions not yet handed to the OnStateChange hook,
+// so that the exporter never waits for it.
+type stateQueue struct {
+	mu      sync.Mutex
+	pending []stateChange
+	kick    chan struct{}
+}
+
+func newStateQueue() *stateQueue {
+	return &stateQueue{kick: make(chan struct{}, 1)}
+}
+
+func (q *stateQueue) push(c stateChange) {
+	q.mu.Lock()
+	q.pending = append(q.pending, c)
+	q.mu.Unlock()
+
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+// deliver calls fn with each transition, in order, until the transition to
+// Shutdown has been delivered.
+func (q *stateQueue) deliver(fn func(old, new State)) {
+	for range q.kick {
+		q.mu.Lock()
+		pending := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+
+		for _, c := range pending {
+			fn(c.old, c.new)
+			if c.new == Shutdown {
+				return
+			}
+		}
+	}
+}
@@ -2,7 +2,6 @@ package agent
 
 import (
 	"io/ioutil"
-	"log"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +13,7 @@ type overflowLogger struct {
 	mu    sync.Mutex
 	pause bool
 	accum int
+	out   LevelLogger
 }
 
 func (o *overflowLogger) delay() {
@@ -24,12 +24,8 @@ func (o *overflowLogger) delay() {
 		switch {
 		case o.accum == 0:
 			o.pause = false
-		case o.accum == 1:
-			log.Println("OpenCensus agent exporter: failed to upload span: buffer full")
-			o.accum = 0
-			o.delay()
 		default:
-			log.Printf("OpenCensus agent exporter: failed to upload %d spans: buffer full", o.accum)
+			o.out.Warn("failed to upload spans: buffer full", "count", o.accum)
 			o.accum = 0
 			o.delay()
 		}
@@ -40,13 +36,48 @@ func (o *overflowLogger) log() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	if !o.pause {
-		log.Println("OpenCensus agent exporter: failed to upload span: buffer full")
+		o.out.Warn("failed to upload spans: buffer full", "count", 1)
 		o.delay()
 	} else {
 		o.accum++
 	}
 }
 
+// uploadGroup waits for uploads running in their own goroutine. Unlike with a
+// sync.WaitGroup, uploads may start while waiting for the others to end.
+type uploadGroup struct {
+	mu   sync.Mutex
+	n    int
+	idle *sync.Cond
+}
+
+func (g *uploadGroup) add() {
+	g.mu.Lock()
+	g.n++
+	g.mu.Unlock()
+}
+
+func (g *uploadGroup) done() {
+	g.mu.Lock()
+	g.n--
+	if g.n == 0 && g.idle != nil {
+		g.idle.Broadcast()
+	}
+	g.mu.Unlock()
+}
+
+// wait blocks until no upload is running.
+func (g *uploadGroup) wait() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.idle == nil {
+		g.idle = sync.NewCond(&g.mu)
+	}
+	for g.n > 0 {
+		g.idle.Wait()
+	}
+}
+
 // configRead reads value by specific config key
 func ConfigRead(path string, key string) string {
 	if path == "" {
@@ -54,7 +85,7 @@ func ConfigRead(path string, key string) string {
 	}
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Println("--> find no file: ", path)
+		packageLogger().Debug("cannot read config file", "path", path, "err", err)
 		return ""
 	}
 
@@ -64,7 +95,7 @@ func ConfigRead(path string, key string) string {
 	for _, line := range lines {
 		kv := strings.Split(line, "=")
 		if kv[0] == key {
-			log.Printf("--> match key[%s], value is: %s\n", key, kv[1])
+			packageLogger().Debug("config key found", "key", key, "value", kv[1])
 			return strings.Trim(kv[1], "\"")
 		}
 	}